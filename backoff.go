@@ -0,0 +1,101 @@
+package logrusbun
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// maxBackoffFingerprints bounds the number of errors tracked by
+// errorBackoff, the least recently seen ones are evicted first
+const maxBackoffFingerprints = 1024
+
+// errorBackoff counts occurrences of identical errors to log them at
+// power-of-two counts only
+type errorBackoff struct {
+	mu      sync.Mutex
+	counts  map[string]*list.Element
+	recency *list.List
+}
+
+type backoffEntry struct {
+	fingerprint string
+	count       uint64
+}
+
+func newErrorBackoff() *errorBackoff {
+	return &errorBackoff{
+		counts:  make(map[string]*list.Element),
+		recency: list.New(),
+	}
+}
+
+// check records an occurrence of fingerprint, returning the occurrence count
+// and whether it should be logged
+func (b *errorBackoff) check(fingerprint string) (count uint64, log bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	elem, ok := b.counts[fingerprint]
+	if ok {
+		b.recency.MoveToFront(elem)
+	} else {
+		if b.recency.Len() >= maxBackoffFingerprints {
+			oldest := b.recency.Back()
+			b.recency.Remove(oldest)
+			delete(b.counts, oldest.Value.(*backoffEntry).fingerprint)
+		}
+		elem = b.recency.PushFront(&backoffEntry{fingerprint: fingerprint})
+		b.counts[fingerprint] = elem
+	}
+	entry := elem.Value.(*backoffEntry)
+	entry.count++
+	return entry.count, entry.count&(entry.count-1) == 0
+}
+
+// errorOnce counts occurrences of distinct errors for only the first one to
+// be logged loudly, sharing the errorBackoff bound on tracked errors
+type errorOnce struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	counts  map[string]*list.Element
+	recency *list.List
+}
+
+type onceEntry struct {
+	fingerprint string
+	count       uint64
+	first       time.Time
+}
+
+func newErrorOnce(ttl time.Duration) *errorOnce {
+	return &errorOnce{
+		ttl:     ttl,
+		counts:  make(map[string]*list.Element),
+		recency: list.New(),
+	}
+}
+
+// check records an occurrence of fingerprint at now, returning the number of
+// occurrences since the first one, which is forgotten after the ttl
+func (o *errorOnce) check(fingerprint string, now time.Time) uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	elem, ok := o.counts[fingerprint]
+	if ok {
+		o.recency.MoveToFront(elem)
+	} else {
+		if o.recency.Len() >= maxBackoffFingerprints {
+			oldest := o.recency.Back()
+			o.recency.Remove(oldest)
+			delete(o.counts, oldest.Value.(*onceEntry).fingerprint)
+		}
+		elem = o.recency.PushFront(&onceEntry{fingerprint: fingerprint})
+		o.counts[fingerprint] = elem
+	}
+	entry := elem.Value.(*onceEntry)
+	if entry.count == 0 || o.ttl > 0 && now.Sub(entry.first) >= o.ttl {
+		entry.count, entry.first = 0, now
+	}
+	entry.count++
+	return entry.count
+}
@@ -0,0 +1,47 @@
+package logrusbun
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestErrorBackoff(t *testing.T) {
+	b := newErrorBackoff()
+	var logged []uint64
+	for i := 0; i < 10; i++ {
+		if count, ok := b.check("boom"); ok {
+			logged = append(logged, count)
+		}
+	}
+	if len(logged) != 4 || logged[0] != 1 || logged[1] != 2 || logged[2] != 4 || logged[3] != 8 {
+		t.Errorf("unexpected logged counts: %v", logged)
+	}
+	if count, ok := b.check("other"); !ok || count != 1 {
+		t.Errorf("expected a new fingerprint to be logged, got %d", count)
+	}
+
+	for i := 0; i < maxBackoffFingerprints; i++ {
+		b.check(strconv.Itoa(i))
+	}
+	if len(b.counts) != maxBackoffFingerprints || b.recency.Len() != maxBackoffFingerprints {
+		t.Errorf("expected %d fingerprints, got %d", maxBackoffFingerprints, len(b.counts))
+	}
+	if count, _ := b.check("boom"); count != 1 {
+		t.Errorf("expected the oldest fingerprint to be evicted, got count %d", count)
+	}
+}
+
+func TestErrorOnce(t *testing.T) {
+	o := newErrorOnce(time.Minute)
+	now := time.Now()
+	if o.check("boom", now) != 1 || o.check("boom", now) != 2 || o.check("other", now) != 1 {
+		t.Fatal("expected occurrences to be counted per fingerprint")
+	}
+	if count := o.check("boom", now.Add(time.Minute)); count != 1 {
+		t.Errorf("expected the error to resurface after the ttl, got count %d", count)
+	}
+	if count := newErrorOnce(0).check("boom", now); count != 1 {
+		t.Errorf("expected a first occurrence without a ttl, got count %d", count)
+	}
+}
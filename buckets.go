@@ -0,0 +1,76 @@
+package logrusbun
+
+import (
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var defaultDurationBuckets = newDurationBuckets(
+	time.Millisecond,
+	10*time.Millisecond,
+	100*time.Millisecond,
+	time.Second,
+)
+
+// durationBuckets labels durations by the range of bounds they fall in
+type durationBuckets struct {
+	bounds []time.Duration
+	labels []string
+}
+
+func newDurationBuckets(bounds ...time.Duration) *durationBuckets {
+	bounds = append([]time.Duration(nil), bounds...)
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	b := &durationBuckets{bounds: bounds}
+	for i, bound := range bounds {
+		if i == 0 {
+			b.labels = append(b.labels, "<"+bound.String())
+		} else {
+			b.labels = append(b.labels, bounds[i-1].String()+"-"+bound.String())
+		}
+	}
+	if len(bounds) > 0 {
+		b.labels = append(b.labels, ">"+bounds[len(bounds)-1].String())
+	}
+	return b
+}
+
+// label returns the bucket d falls in, bounds are exclusive upper limits
+func (b *durationBuckets) label(d time.Duration) string {
+	if len(b.bounds) == 0 {
+		return ""
+	}
+	i := sort.Search(len(b.bounds), func(i int) bool { return d < b.bounds[i] })
+	return b.labels[i]
+}
+
+// DurationTier names the queries lasting at least Threshold and, when Level
+// is set, logs successful ones at Level
+type DurationTier struct {
+	Threshold time.Duration
+	Name      string
+	Level     logrus.Level
+}
+
+// durationTiers matches durations to the tier with the highest threshold
+// they reach
+type durationTiers []DurationTier
+
+func newDurationTiers(tiers []DurationTier) durationTiers {
+	sorted := append(durationTiers(nil), tiers...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Threshold > sorted[j].Threshold })
+	return sorted
+}
+
+// match returns the tier of d, or nil when d is below every threshold
+func (t durationTiers) match(d time.Duration) *DurationTier {
+	for i := range t {
+		if d >= t[i].Threshold {
+			return &t[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package logrusbun
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDurationBuckets(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "<1ms"},
+		{time.Millisecond, "1ms-10ms"},
+		{50 * time.Millisecond, "10ms-100ms"},
+		{999 * time.Millisecond, "100ms-1s"},
+		{time.Minute, ">1s"},
+	}
+	for _, test := range tests {
+		if got := defaultDurationBuckets.label(test.d); got != test.want {
+			t.Errorf("label(%s) = %q, want %q", test.d, got, test.want)
+		}
+	}
+
+	custom := newDurationBuckets(time.Second, 100*time.Millisecond)
+	if got := custom.label(200 * time.Millisecond); got != "100ms-1s" {
+		t.Errorf("expected unsorted bounds to be sorted, got %q", got)
+	}
+}
+
+func TestDurationTiersMatch(t *testing.T) {
+	tiers := newDurationTiers([]DurationTier{
+		{Threshold: time.Second, Name: "slow"},
+		{Threshold: 0, Name: "normal"},
+		{Threshold: 10 * time.Second, Name: "critical"},
+	})
+	for d, want := range map[time.Duration]string{
+		0:                "normal",
+		time.Second:      "slow",
+		11 * time.Second: "critical",
+	} {
+		if tier := tiers.match(d); tier == nil || tier.Name != want {
+			t.Errorf("match(%s) = %v, want %s", d, tier, want)
+		}
+	}
+	if tier := newDurationTiers([]DurationTier{{Threshold: time.Second}}).match(time.Millisecond); tier != nil {
+		t.Errorf("expected no tier, got %v", tier)
+	}
+}
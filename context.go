@@ -0,0 +1,179 @@
+package logrusbun
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/uptrace/bun"
+)
+
+type ctxKey int
+
+const (
+	queryIDKey ctxKey = iota
+	retryableAttemptKey
+	queryNameKey
+	txIDKey
+	traceIDKey
+	lastQueryKey
+	cacheStatusKey
+	expectedIsolationKey
+	txIsolationKey
+	fingerprintKey
+)
+
+// QueryIDFromContext returns the query ID generated by a hook configured
+// with WithQueryID, or an empty string
+func QueryIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(queryIDKey).(string)
+	return id
+}
+
+// WithRetryableAttempt marks queries run with the returned context as an
+// attempt that will be retried on failure, see QueryHookOptions.RetryLevel
+func WithRetryableAttempt(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryableAttemptKey, true)
+}
+
+func isRetryableAttempt(ctx context.Context) bool {
+	retryable, _ := ctx.Value(retryableAttemptKey).(bool)
+	return retryable
+}
+
+// FingerprintFromContext returns the query fingerprint stored by a hook
+// configured with WithPropagateFingerprint, or an empty string. Hooks added
+// after it and drivers receive the context returned by its BeforeQuery, the
+// fingerprint is stored under a key private to this package and is only
+// reachable through this function
+func FingerprintFromContext(ctx context.Context) string {
+	fp, _ := ctx.Value(fingerprintKey).(string)
+	return fp
+}
+
+// WithQueryName names queries run with the returned context, the name is
+// made available to templates as {{.Name}}. bun doesn't carry operation
+// names of its own in the context or the QueryEvent, there is nothing to
+// pick up from it instead
+func WithQueryName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, queryNameKey, name)
+}
+
+// QueryNameFromContext returns the name set with WithQueryName, or an empty
+// string
+func QueryNameFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(queryNameKey).(string)
+	return name
+}
+
+// WithTxID tags queries run with the returned context with a transaction
+// ID, made available to templates as {{.TxID}}. bun doesn't notify hooks of
+// transaction boundaries, the application is responsible for seeding the ID
+// when it starts the transaction:
+//
+//	ctx = logrusbun.WithTxID(ctx, uuid.NewString())
+//	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error { ... })
+func WithTxID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, txIDKey, id)
+}
+
+// TxIDFromContext returns the transaction ID set with WithTxID, or an empty
+// string
+func TxIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(txIDKey).(string)
+	return id
+}
+
+// WithTraceID tags queries run with the returned context with the ID of the
+// trace they belong to, used by WithTraceSampling to decide per trace
+func WithTraceID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceIDKey, id)
+}
+
+// TraceIDFromContext returns the trace ID set with WithTraceID, or an empty
+// string
+func TraceIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey).(string)
+	return id
+}
+
+// WithCacheStatus records the outcome of an application level cache lookup
+// preceding the queries run with the returned context, eg: "hit" or "miss",
+// made available to templates as {{.CacheStatus}}
+func WithCacheStatus(ctx context.Context, status string) context.Context {
+	return context.WithValue(ctx, cacheStatusKey, status)
+}
+
+// CacheStatusFromContext returns the cache status set with WithCacheStatus,
+// or an empty string
+func CacheStatusFromContext(ctx context.Context) string {
+	status, _ := ctx.Value(cacheStatusKey).(string)
+	return status
+}
+
+// WithExpectedIsolation marks the queries run with the returned context as
+// requiring the given transaction isolation level. Queries of a transaction
+// tagged with a different level by WithTxIsolation are logged at WarnLevel
+// with {{.IsolationMismatch}}
+func WithExpectedIsolation(ctx context.Context, level sql.IsolationLevel) context.Context {
+	return context.WithValue(ctx, expectedIsolationKey, level)
+}
+
+// WithTxIsolation tags the queries run with the returned context with the
+// isolation level of their transaction. bun doesn't expose transaction
+// options to hooks, the application seeds it alongside the options it
+// starts the transaction with:
+//
+//	opts := &sql.TxOptions{Isolation: sql.LevelSerializable}
+//	ctx = logrusbun.WithTxIsolation(ctx, opts.Isolation)
+//	err := db.RunInTx(ctx, opts, func(ctx context.Context, tx bun.Tx) error { ... })
+func WithTxIsolation(ctx context.Context, level sql.IsolationLevel) context.Context {
+	return context.WithValue(ctx, txIsolationKey, level)
+}
+
+// isolationMismatch describes the difference between the expected and the
+// actual isolation levels in ctx, or returns an empty string when they match
+// or either is missing
+func isolationMismatch(ctx context.Context) string {
+	expected, ok := ctx.Value(expectedIsolationKey).(sql.IsolationLevel)
+	if !ok {
+		return ""
+	}
+	actual, ok := ctx.Value(txIsolationKey).(sql.IsolationLevel)
+	if !ok || actual == expected {
+		return ""
+	}
+	return "expected " + expected.String() + ", got " + actual.String()
+}
+
+// lastQuery holds the last query started with a context returned by
+// WithLastQuery
+type lastQuery struct {
+	mu    sync.Mutex
+	event *bun.QueryEvent
+}
+
+// WithLastQuery returns a context in which enabled hooks record the last
+// query started, for QueryHook.LogPanic to report the query in flight when
+// the application panics
+func WithLastQuery(ctx context.Context) context.Context {
+	return context.WithValue(ctx, lastQueryKey, new(lastQuery))
+}
+
+func setLastQuery(ctx context.Context, event *bun.QueryEvent) {
+	if last, ok := ctx.Value(lastQueryKey).(*lastQuery); ok {
+		last.mu.Lock()
+		last.event = event
+		last.mu.Unlock()
+	}
+}
+
+func lastQueryFromContext(ctx context.Context) *bun.QueryEvent {
+	last, ok := ctx.Value(lastQueryKey).(*lastQuery)
+	if !ok {
+		return nil
+	}
+	last.mu.Lock()
+	defer last.mu.Unlock()
+	return last.event
+}
@@ -0,0 +1,45 @@
+package logrusbun
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dedup tracks the last logged query to skip identical consecutive ones
+type dedup struct {
+	mu  sync.Mutex
+	run dedupRun
+}
+
+// dedupRun is a run of consecutive entries sharing the same key and level
+type dedupRun struct {
+	key     string
+	level   logrus.Level
+	isError bool
+	repeats int
+}
+
+// check reports whether the entry identified by key repeats the previous
+// one. When a run of repeats ends, it is returned so it can be flushed
+func (d *dedup) check(key string, level logrus.Level, isError bool) (skip bool, ended dedupRun) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if key == d.run.key && level == d.run.level && isError == d.run.isError {
+		d.run.repeats++
+		return true, dedupRun{}
+	}
+	ended = d.run
+	d.run = dedupRun{key: key, level: level, isError: isError}
+	return false, ended
+}
+
+// flush returns the pending run of repeats, if any, and resets its count.
+// A following identical entry still counts as a repeat
+func (d *dedup) flush() dedupRun {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ended := d.run
+	d.run.repeats = 0
+	return ended
+}
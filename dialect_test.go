@@ -0,0 +1,45 @@
+package logrusbun
+
+import (
+	"database/sql"
+	"reflect"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect"
+	"github.com/uptrace/bun/dialect/feature"
+	"github.com/uptrace/bun/schema"
+)
+
+// testDialect is a minimal sqlite flavored dialect allowing tests to build
+// and format bun queries without a database
+type testDialect struct {
+	tables *schema.Tables
+}
+
+func newTestDB() *bun.DB {
+	d := new(testDialect)
+	d.tables = schema.NewTables(d)
+	return bun.NewDB(nil, d)
+}
+
+func (d *testDialect) Init(*sql.DB)                {}
+func (d *testDialect) Name() dialect.Name          { return dialect.SQLite }
+func (d *testDialect) Features() feature.Feature   { return feature.Returning }
+func (d *testDialect) Tables() *schema.Tables      { return d.tables }
+func (d *testDialect) OnTable(table *schema.Table) {}
+func (d *testDialect) IdentQuote() byte            { return '"' }
+func (d *testDialect) Scanner(typ reflect.Type) schema.ScannerFunc {
+	return schema.Scanner(typ)
+}
+
+func (d *testDialect) Append(fmter schema.Formatter, b []byte, v interface{}) []byte {
+	return schema.Append(fmter, b, v, nil)
+}
+
+func (d *testDialect) Appender(typ reflect.Type) schema.AppenderFunc {
+	return schema.Appender(typ, nil)
+}
+
+func (d *testDialect) FieldAppender(field *schema.Field) schema.AppenderFunc {
+	return schema.FieldAppender(d, field)
+}
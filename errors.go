@@ -0,0 +1,54 @@
+package logrusbun
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sqlStateError is implemented by pgx (pgconn.PgError) and lib/pq errors
+type sqlStateError interface {
+	SQLState() string
+}
+
+// fieldError is implemented by bun's pgdriver errors
+type fieldError interface {
+	Field(k byte) string
+}
+
+// errorSQLState returns the SQLSTATE code carried by err, or an empty string
+func errorSQLState(err error) string {
+	var stateErr sqlStateError
+	if errors.As(err, &stateErr) {
+		return stateErr.SQLState()
+	}
+	var fieldErr fieldError
+	if errors.As(err, &fieldErr) {
+		return fieldErr.Field('C')
+	}
+	return ""
+}
+
+// isRetryableError reports whether err is a transient failure that is
+// expected to succeed on retry (serialization failure, deadlock)
+func isRetryableError(err error) bool {
+	switch errorSQLState(err) {
+	case "40001", "40P01":
+		return true
+	}
+	return false
+}
+
+// sqlStateLevel returns the level configured in levels for the SQLSTATE code
+// carried by err, if any
+func sqlStateLevel(levels map[string]logrus.Level, err error) (logrus.Level, bool) {
+	if len(levels) == 0 {
+		return 0, false
+	}
+	code := errorSQLState(err)
+	if code == "" {
+		return 0, false
+	}
+	level, ok := levels[code]
+	return level, ok
+}
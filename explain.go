@@ -0,0 +1,84 @@
+package logrusbun
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect"
+)
+
+const (
+	// explainTimeout bounds the time spent explaining a slow query
+	explainTimeout = time.Second
+	// maxConcurrentExplains bounds the number of slow queries explained at
+	// once, not to pile load on a database already slowing down
+	maxConcurrentExplains = 4
+)
+
+// explainable reports whether the event is a single, fully formatted SELECT
+// that can safely be explained
+func explainable(event *bun.QueryEvent) bool {
+	if event.DB == nil || event.DB.DB == nil || event.DB.Dialect() == nil || len(event.QueryArgs) > 0 {
+		return false
+	}
+	return isSingleSelect(event.Query)
+}
+
+// isSingleSelect reports whether query is a single SELECT statement
+func isSingleSelect(query string) bool {
+	query = strings.TrimSpace(query)
+	if strings.Contains(strings.TrimSuffix(query, ";"), ";") {
+		return false
+	}
+	return len(query) > len("SELECT") && strings.EqualFold(query[:len("SELECT")], "SELECT")
+}
+
+// explain returns the plan of the event's query. EXPLAIN is run without
+// ANALYZE, on the underlying *sql.DB so hooks aren't triggered, in a read
+// only transaction and bounded by explainTimeout
+func explain(event *bun.QueryEvent) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), explainTimeout)
+	defer cancel()
+
+	tx, err := event.DB.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	prefix := "EXPLAIN "
+	if event.DB.Dialect().Name() == dialect.SQLite {
+		prefix = "EXPLAIN QUERY PLAN "
+	}
+	rows, err := tx.QueryContext(ctx, prefix+event.Query)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	var lines []string
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return "", err
+		}
+		parts := make([]string, len(values))
+		for i, v := range values {
+			parts[i] = string(v)
+		}
+		lines = append(lines, strings.Join(parts, " "))
+	}
+	return strings.Join(lines, "\n"), rows.Err()
+}
@@ -0,0 +1,21 @@
+package logrusbun
+
+import "testing"
+
+func TestIsSingleSelect(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"SELECT 1", true},
+		{"  select * from t;", true},
+		{"SELECT 1; DELETE FROM t", false},
+		{"DELETE FROM t", false},
+		{"SELECT", false},
+	}
+	for _, test := range tests {
+		if got := isSingleSelect(test.query); got != test.want {
+			t.Errorf("isSingleSelect(%q) = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package logrusbun
+
+import (
+	"text/template"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// templateFuncs are available to every template
+var templateFuncs = template.FuncMap{
+	"ms":         durationMillis,
+	"humanize":   humanizeDuration,
+	"over":       durationOver,
+	"sinceStart": sinceStart,
+}
+
+// durationMillis returns d in milliseconds, eg: {{ms .Duration}} renders 1.5
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// humanizeDuration rounds d to about 3 significant digits, eg: 12.35ms
+func humanizeDuration(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		d = d.Round(10 * time.Millisecond)
+	case d >= time.Millisecond:
+		d = d.Round(10 * time.Microsecond)
+	case d >= time.Microsecond:
+		d = d.Round(10 * time.Nanosecond)
+	}
+	return d.String()
+}
+
+// durationOver reports whether d exceeds budget, a time.ParseDuration
+// string, eg: {{if over .Duration "100ms"}}
+func durationOver(d time.Duration, budget string) (bool, error) {
+	limit, err := time.ParseDuration(budget)
+	if err != nil {
+		return false, err
+	}
+	return d > limit, nil
+}
+
+// sinceStart returns the time elapsed since the event started, eg:
+// {{sinceStart .Event}}, 0 without an event or a start time
+func sinceStart(event *bun.QueryEvent) time.Duration {
+	if event == nil || event.StartTime.IsZero() {
+		return 0
+	}
+	return time.Since(event.StartTime)
+}
@@ -0,0 +1,38 @@
+package logrusbun
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	tmpl := parseTemplate("test", `{{ms .Duration}} {{humanize .Duration}} {{over .Duration "10ms"}} {{over .Duration "1s"}}`, [2]string{})
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, &LogEntryVars{Duration: 12345678 * time.Nanosecond}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "12.345678 12.35ms true false" {
+		t.Errorf("unexpected rendering: %q", b.String())
+	}
+
+	if err := parseTemplate("test", `{{over .Duration "soon"}}`, [2]string{}).Execute(&b, &LogEntryVars{}); err == nil {
+		t.Error("expected an invalid budget to fail")
+	}
+
+	for d, want := range map[time.Duration]string{
+		1234567891 * time.Nanosecond: "1.23s",
+		1234 * time.Nanosecond:       "1.23µs",
+		999 * time.Nanosecond:        "999ns",
+	} {
+		if got := humanizeDuration(d); got != want {
+			t.Errorf("humanizeDuration(%d) = %q, want %q", d, got, want)
+		}
+	}
+
+	if sinceStart(nil) != 0 || sinceStart(&bun.QueryEvent{StartTime: time.Now().Add(-time.Hour)}) < time.Hour {
+		t.Error("unexpected sinceStart")
+	}
+}
@@ -4,11 +4,23 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
 	"os"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
+	"text/template/parse"
 	"time"
+	"unicode/utf8"
 
 	"github.com/sirupsen/logrus"
 	"github.com/uptrace/bun"
@@ -31,6 +43,711 @@ func WithVerbose(on bool) Option {
 	}
 }
 
+// WithQueryID configures the hook to generate a short ID for every query in
+// BeforeQuery, made available to templates as {{.QueryID}}
+func WithQueryID(on bool) Option {
+	return func(h *QueryHook) {
+		h.queryID = on
+	}
+}
+
+// WithFingerprint configures the hook to identify the shape of every logged
+// query, regardless of its literal values, with a stable hash made available
+// to templates as {{.Fingerprint}} and logged as the "fingerprint" field
+func WithFingerprint(on bool) Option {
+	return func(h *QueryHook) {
+		h.fingerprint = on
+	}
+}
+
+// WithPropagateFingerprint enables WithFingerprint and stores the fingerprint
+// in the context returned by BeforeQuery, for the hooks added after this one
+// (eg: a tracing hook) and the driver to tag their spans with the same query
+// identity, see FingerprintFromContext
+func WithPropagateFingerprint(on bool) Option {
+	return func(h *QueryHook) {
+		h.fingerprintCtx = on
+		if on {
+			h.fingerprint = true
+		}
+	}
+}
+
+// WithClock replaces time.Now as the source of the current time, mostly for
+// tests to control entry timestamps and slow query detection. Durations are
+// measured from the event's StartTime, set by bun with time.Now, test events
+// should be built relative to the clock. The sinceStart template function
+// keeps using time.Since
+func WithClock(now func() time.Time) Option {
+	return func(h *QueryHook) {
+		h.clock = now
+	}
+}
+
+// WithRand replaces the source used for sampling and query IDs, by default
+// a math/rand source owned by the hook and seeded with the time it was
+// created at, mostly for tests to get reproducible decisions. Draws from r
+// are serialized, r must not be used elsewhere while the hook is in use
+func WithRand(r *rand.Rand) Option {
+	return func(h *QueryHook) {
+		h.rng = r
+	}
+}
+
+// WithWriter configures the hook to log to w using a minimal text logger,
+// replacing QueryHookOptions.Logger
+func WithWriter(w io.Writer) Option {
+	return func(h *QueryHook) {
+		h.writer = w
+	}
+}
+
+// WithSanitizeInClauses collapses IN (...) lists longer than max elements
+// in the logged query, eg: IN (... 5000 values ...)
+func WithSanitizeInClauses(max int) Option {
+	return func(h *QueryHook) {
+		h.queryFormatters = append(h.queryFormatters, func(query string) string {
+			return collapseInLists(query, max)
+		})
+	}
+}
+
+// WithTraceSampled configures the hook to log successful queries only when
+// fn reports the current trace as sampled, overriding verbose mode.
+// When fn returns ok=false (no trace in ctx) the verbose setting applies.
+// Failed queries are always logged.
+func WithTraceSampled(fn func(ctx context.Context) (sampled bool, ok bool)) Option {
+	return func(h *QueryHook) {
+		h.traceSampled = fn
+	}
+}
+
+// WithTraceSampling configures the hook to log successful queries of the
+// given fraction of traces (0 < rate <= 1), all or none of the queries of
+// a trace are logged. The decision hashes the trace ID set with
+// logrusbun.WithTraceID(ctx, id), queries without one are sampled
+// individually at rate. It overrides verbose mode but not WithTraceSampled
+// when the latter finds a trace
+func WithTraceSampling(rate float64) Option {
+	return func(h *QueryHook) {
+		h.traceSampling = rate
+	}
+}
+
+// WithStructuredFields configures the hook to attach the query details as
+// logrus fields (query, operation, duration, error...), the templates are
+// not rendered and every entry is logged with QueryHookOptions.StructuredMessage
+func WithStructuredFields(on bool) Option {
+	return func(h *QueryHook) {
+		h.structured = on
+	}
+}
+
+// WithNestedQueryField groups the query details of structured entries in a
+// single fieldName field, an object made of text, fingerprint (with
+// WithFingerprint), operation, table and bytes, instead of the top level
+// query, operation, table and query_bytes fields. It only applies with
+// WithStructuredFields(true)
+func WithNestedQueryField(fieldName string) Option {
+	return func(h *QueryHook) {
+		h.nestedQueryField = fieldName
+	}
+}
+
+// WithErrorFieldName sets the field holding the error of failed queries
+// in structured mode, overriding QueryHookOptions.ErrorFieldName regardless
+// of the option order. The error is never part of the structured message
+func WithErrorFieldName(name string) Option {
+	return func(h *QueryHook) {
+		h.errorFieldName = name
+	}
+}
+
+// WithMaxLevel caps the severity of every log entry emitted by the hook.
+// Logrus orders levels from most to least severe: Panic(0), Fatal(1),
+// Error(2), Warn(3), Info(4), Debug(5), Trace(6), so WithMaxLevel(logrus.InfoLevel)
+// logs an error that would otherwise be logged at ErrorLevel at InfoLevel
+func WithMaxLevel(level logrus.Level) Option {
+	return func(h *QueryHook) {
+		h.maxLevel = level
+	}
+}
+
+// WithGoroutineID configures the hook to capture the ID of the goroutine
+// running the query as {{.GID}}. It relies on parsing runtime.Stack and is
+// meant for debugging concurrency issues, not for production use
+func WithGoroutineID(on bool) Option {
+	return func(h *QueryHook) {
+		h.goroutineID = on
+	}
+}
+
+// WithEventFilter configures fn as the first gate of AfterQuery, it replaces
+// the enabled/verbose checks: events it returns false for are dropped, while
+// events it returns true for are logged even when the hook is disabled or
+// not verbose. Levels still apply, an event resolving to an unset level is
+// not logged. BeforeQuery prepares every query for the filter to force,
+// generating query IDs and recording the last query even when disabled
+func WithEventFilter(fn func(ctx context.Context, event *bun.QueryEvent) bool) Option {
+	return func(h *QueryHook) {
+		h.eventFilter = fn
+	}
+}
+
+// WithQueryAllowlist configures the hook to only log queries, failed ones
+// included, whose SQL matches re, eg: regexp.MustCompile(`\borders\b`)
+func WithQueryAllowlist(re *regexp.Regexp) Option {
+	return func(h *QueryHook) {
+		h.queryAllowlist = re
+	}
+}
+
+// WithSessionID configures fn to resolve the database session of a query
+// (eg: the postgres backend PID) as {{.SessionID}}. bun's QueryEvent doesn't
+// expose the underlying connection, fn is expected to reach it in a driver
+// specific way, typically from a value the application stored in ctx after
+// running SELECT pg_backend_pid() on a dedicated bun.Conn
+func WithSessionID(fn func(ctx context.Context, event *bun.QueryEvent) string) Option {
+	return func(h *QueryHook) {
+		h.sessionID = fn
+	}
+}
+
+// WithDeduplicateConsecutive configures the hook to skip queries with the
+// same fingerprint (see WithFingerprint), outcome and level as the
+// previously logged one, the number of skipped repeats is logged once a
+// different query comes in or on Flush
+func WithDeduplicateConsecutive(on bool) Option {
+	return func(h *QueryHook) {
+		if on {
+			h.dedup = new(dedup)
+		} else {
+			h.dedup = nil
+		}
+	}
+}
+
+// WithErrorOnceThenQuiet configures the hook to log the first occurrence of
+// every distinct error, identified by the query fingerprint (see
+// WithFingerprint) and the SQLSTATE code or the error message without one,
+// at its usual level and the following ones at DebugLevel, with the
+// occurrence count as the "occurrences" field. New failure modes stand out
+// while known ones are muted, see WithErrorOnceTTL for them to resurface
+func WithErrorOnceThenQuiet(on bool) Option {
+	return func(h *QueryHook) {
+		if on {
+			h.errorOnce = newErrorOnce(h.errorOnceTTL)
+		} else {
+			h.errorOnce = nil
+		}
+	}
+}
+
+// WithErrorOnceTTL makes errors muted by WithErrorOnceThenQuiet resurface
+// once ttl has passed since they were first logged, by default they stay
+// muted until evicted, after 1024 more recent distinct errors
+func WithErrorOnceTTL(ttl time.Duration) Option {
+	return func(h *QueryHook) {
+		h.errorOnceTTL = ttl
+		if h.errorOnce != nil {
+			h.errorOnce.ttl = ttl
+		}
+	}
+}
+
+// WithDeadlinePressureWarn configures the hook to flag successful queries
+// that used more than fraction of the time left before their context
+// deadline when they started, eg: 0.9. Flagged queries are logged at level
+// (unless already logged more severely) with a "deadline_pressure" field
+// holding the fraction used, also available to templates as
+// {{.DeadlinePressure}}. Queries without a deadline are unaffected
+func WithDeadlinePressureWarn(fraction float64, level logrus.Level) Option {
+	return func(h *QueryHook) {
+		h.deadlineFraction = fraction
+		h.deadlineLevel = level
+	}
+}
+
+// WithWarnMissingWhere configures the hook to log UPDATE and DELETE
+// statements without a WHERE clause at level, whether they succeed or not
+// (unless already logged more severely), with a "missing_where" field. The
+// detection is conservative, see {{.MissingWhere}}
+func WithWarnMissingWhere(level logrus.Level) Option {
+	return func(h *QueryHook) {
+		h.missingWhereLevel = level
+	}
+}
+
+// WithErrorBackoff configures the hook to log repeated identical errors
+// (same query fingerprint, see WithFingerprint, and error message) at their 1st, 2nd, 4th, 8th... occurrence
+// only, the occurrence count is attached as the "occurrences" field and
+// made available to templates as {{.Occurrences}}
+func WithErrorBackoff(on bool) Option {
+	return func(h *QueryHook) {
+		if on {
+			h.errorBackoff = newErrorBackoff()
+		} else {
+			h.errorBackoff = nil
+		}
+	}
+}
+
+// WithOnError configures fn to be called when the hook itself fails, eg: a
+// template failing to render. The query is then logged with a minimal
+// message instead of panicking
+func WithOnError(fn func(error)) Option {
+	return func(h *QueryHook) {
+		h.onError = fn
+	}
+}
+
+// WithCompact configures the hook to log a "q" field holding operation,
+// duration, rows affected and error joined by sep with an empty message, eg:
+// SELECT|1.2ms|1|. Templates and structured fields are not used, the fields
+// added to every entry are, eg: WithTenantKey or WithName. Backslashes and
+// occurrences of sep within a value are escaped with a backslash, rows is
+// empty when unknown
+func WithCompact(sep string) Option {
+	return func(h *QueryHook) {
+		h.compactSep = sep
+	}
+}
+
+// WithArgRedaction configures the hook to log raw queries (db.ExecContext,
+// db.QueryContext...) with every bound argument replaced by mask, eg:
+// WHERE email = ***. bun formats queries built with the query builder before
+// they reach the hook and doesn't expose argument boundaries, those are
+// logged as is
+func WithArgRedaction(mask string) Option {
+	return func(h *QueryHook) {
+		h.argMask = mask
+	}
+}
+
+// WithMaskPatterns masks the matches of patterns in the logged query with
+// mask, only the first capture group is masked for patterns having one, eg:
+// regexp.MustCompile(`ssn = '(\d+)'`). It runs after WithArgRedaction and
+// before the other query formatters
+func WithMaskPatterns(mask string, patterns ...*regexp.Regexp) Option {
+	return func(h *QueryHook) {
+		h.queryRedactors = append(h.queryRedactors, func(query string) string {
+			return maskPatterns(query, mask, patterns)
+		})
+	}
+}
+
+// WithContextCancellationGrace configures the hook to treat any error of a
+// query whose context is done by the time it completes as a cancellation,
+// logged at QueryHookOptions.CanceledLevel, for drivers returning errors
+// that don't unwrap to context.Canceled
+func WithContextCancellationGrace(on bool) Option {
+	return func(h *QueryHook) {
+		h.cancellationGrace = on
+	}
+}
+
+// WithIgnoreContextCanceledDuration configures the hook to skip queries
+// failing with a cancellation (see WithContextCancellationGrace) after running
+// for at least d. Client initiated cancels, eg: during disconnect storms, tend
+// to hit queries already in flight for a while, while quick cancellations
+// point at a real problem. Disabled by default
+func WithIgnoreContextCanceledDuration(d time.Duration) Option {
+	return func(h *QueryHook) {
+		h.canceledAfter = d
+	}
+}
+
+// WithAllowProcessTermination allows the hook to log at FatalLevel, which
+// exits the process, and PanicLevel, which panics. Otherwise entries
+// resolving to these levels are logged at ErrorLevel with an
+// "intended_level" field
+func WithAllowProcessTermination(on bool) Option {
+	return func(h *QueryHook) {
+		h.allowTermination = on
+	}
+}
+
+// WithSlowFullQuery configures the hook to log slow queries without
+// shortening them, eg: with WithSanitizeInClauses. Redaction with
+// WithArgRedaction, WithMaskPatterns or WithDefaultMasking still applies
+func WithSlowFullQuery(on bool) Option {
+	return func(h *QueryHook) {
+		h.slowFullQuery = on
+	}
+}
+
+// WithDefaultMasking masks common secret-looking literals with "***":
+// values of password, secret, token and api key columns, bearer tokens,
+// JWTs and long hex or base64 strings. extra patterns are masked as well,
+// eg: WithDefaultMasking(logrusbun.MaskPatternEmail). Detection is
+// heuristic, it doesn't replace WithArgRedaction for raw queries
+func WithDefaultMasking(extra ...*regexp.Regexp) Option {
+	patterns := append(append([]*regexp.Regexp(nil), defaultMaskPatterns...), extra...)
+	return WithMaskPatterns("***", patterns...)
+}
+
+// WithQueryTransforms configures transforms to apply in order to the logged
+// query, eg: to strip comments or truncate it. They run after the built-in
+// redaction and normalization and before pretty printing, the first query
+// they get is safe to log
+func WithQueryTransforms(transforms ...func(query string) string) Option {
+	return func(h *QueryHook) {
+		h.queryTransforms = append(h.queryTransforms, transforms...)
+	}
+}
+
+// WithPrettyPrint configures the hook to log queries over multiple indented
+// lines with uppercased keywords, meant for development. Pretty printing runs
+// after every other query formatter, any whitespace normalization is undone
+func WithPrettyPrint(on bool) Option {
+	return func(h *QueryHook) {
+		h.prettyPrint = on
+	}
+}
+
+// WithMaxConcurrentLogs bounds the number of queries being rendered and
+// logged concurrently to n, queries beyond the limit are dropped and counted
+// in Summary().Dropped. By default concurrency is unlimited
+func WithMaxConcurrentLogs(n int) Option {
+	return func(h *QueryHook) {
+		if n > 0 {
+			h.logSlots = make(chan struct{}, n)
+		} else {
+			h.logSlots = nil
+		}
+	}
+}
+
+// WithDurationBuckets configures the edges of the duration ranges queries
+// are labeled with as {{.DurationBucket}}, eg: "<1ms", "1ms-10ms", ">1s".
+// Defaults to 1ms, 10ms, 100ms and 1s
+func WithDurationBuckets(bounds ...time.Duration) Option {
+	return func(h *QueryHook) {
+		h.durationBuckets = newDurationBuckets(bounds...)
+	}
+}
+
+// WithSlowStack configures the hook to capture up to depth frames of the
+// application call stack issuing slow queries, attached as the "stack"
+// field and made available to templates as {{.Stack}}. Capturing a stack
+// is relatively expensive and only happens for queries exceeding LogSlow
+func WithSlowStack(depth int) Option {
+	return func(h *QueryHook) {
+		h.slowStack = depth
+	}
+}
+
+// WithModuleAttribution configures the hook to attribute every logged query
+// to the package issuing it, the first caller outside of the hook, bun and
+// database/sql, with prefixTrim trimmed, eg: "repo/users" for
+// github.com/acme/app/repo/users with prefixTrim "github.com/acme/app/". It
+// is attached as the "module" field and made available to templates as
+// {{.Module}}, giving a per module breakdown of query volume and latency
+func WithModuleAttribution(prefixTrim string) Option {
+	return func(h *QueryHook) {
+		h.moduleAttribution = true
+		h.modulePrefix = prefixTrim
+	}
+}
+
+// WithAbbreviatedOperation configures the hook to log short operation
+// codes as {{.Operation}}: SELECT S, INSERT I, UPDATE U, DELETE D,
+// CREATE TABLE CT, DROP TABLE DT, CREATE INDEX CI, DROP INDEX DI, BEGIN B,
+// COMMIT C, ROLLBACK R. Other operations keep their full name
+func WithAbbreviatedOperation(on bool) Option {
+	return func(h *QueryHook) {
+		h.shortOperation = on
+	}
+}
+
+// WithOperationAliases renames operations in {{.Operation}} and the
+// operation field, eg: map[string]string{"SELECT": "read", "INSERT": "create"}.
+// Operations are matched case insensitively, unmapped ones are left as is
+// (or abbreviated with WithAbbreviatedOperation)
+func WithOperationAliases(aliases map[string]string) Option {
+	return func(h *QueryHook) {
+		h.operationAliases = make(map[string]string, len(aliases))
+		for op, alias := range aliases {
+			h.operationAliases[strings.ToUpper(op)] = alias
+		}
+	}
+}
+
+// WithDurationTiers annotates queries with the name of the tier matching
+// their duration as the "tier" field and {{.Tier}}, eg:
+//
+//	WithDurationTiers([]DurationTier{
+//		{Threshold: 0, Name: "normal"},
+//		{Threshold: 100 * time.Millisecond, Name: "elevated", Level: logrus.InfoLevel},
+//		{Threshold: time.Second, Name: "slow", Level: logrus.WarnLevel},
+//		{Threshold: 10 * time.Second, Name: "critical", Level: logrus.ErrorLevel},
+//	})
+//
+// A query matches the tier with the highest threshold it reaches, successful
+// queries are logged at its level when set, instead of QueryLevel or
+// SlowLevel, and bypass sampling when it is more severe than QueryLevel.
+// Failed queries keep their level. Without tiers LogSlow applies
+func WithDurationTiers(tiers []DurationTier) Option {
+	return func(h *QueryHook) {
+		h.durationTiers = newDurationTiers(tiers)
+	}
+}
+
+// WithSequence configures the hook to number logged queries with a per hook
+// monotonically increasing {{.Seq}}, starting at 1, to restore ordering after
+// sinks that may reorder entries
+func WithSequence(on bool) Option {
+	return func(h *QueryHook) {
+		h.sequence = on
+	}
+}
+
+// WithLevelRemap translates resolved levels right before they are emitted,
+// eg: {logrus.WarnLevel: logrus.InfoLevel}. Unlisted levels are unchanged
+func WithLevelRemap(remap map[logrus.Level]logrus.Level) Option {
+	return func(h *QueryHook) {
+		h.levelRemap = make(map[logrus.Level]logrus.Level, len(remap))
+		for from, to := range remap {
+			h.levelRemap[from] = to
+		}
+	}
+}
+
+// WithPerQueryRateLimit caps logging to perSecond entries per second for
+// every distinct query fingerprint (see WithFingerprint), independently of
+// each other, for a single hot query not to crowd out the others. Failed
+// queries are limited too unless WithErrorsBypassPerQueryRateLimit is set,
+// queries beyond the limit are dropped and counted in Summary().Dropped. At
+// most 1024 fingerprints are tracked, the least recently logged ones are
+// evicted first
+func WithPerQueryRateLimit(perSecond int) Option {
+	return func(h *QueryHook) {
+		if perSecond > 0 {
+			h.queryRateLimit = newQueryRateLimit(perSecond)
+		} else {
+			h.queryRateLimit = nil
+		}
+	}
+}
+
+// WithErrorsBypassPerQueryRateLimit exempts failed queries from
+// WithPerQueryRateLimit
+func WithErrorsBypassPerQueryRateLimit(on bool) Option {
+	return func(h *QueryHook) {
+		h.errorsBypassRate = on
+	}
+}
+
+// WithRateLimit caps logging of successful queries to perSecond entries per
+// second across all queries, allowing bursts of up to perSecond. Queries
+// beyond the limit are dropped and counted in Summary().Dropped, failed
+// queries bypass the limit
+func WithRateLimit(perSecond int) Option {
+	return func(h *QueryHook) {
+		if perSecond > 0 {
+			h.rateLimit = newTokenBucket(perSecond)
+		} else {
+			h.rateLimit = nil
+		}
+	}
+}
+
+// WithExplainSlow configures the hook to run EXPLAIN for slow SELECTs and
+// attach the plan as {{.Plan}}. EXPLAIN runs without ANALYZE in a read only
+// transaction bounded by a one second timeout, and only for single, fully
+// formatted SELECT statements. Failures are reported to the OnError
+// callback, if any. EXPLAIN blocks the goroutine that ran the query, up to
+// the timeout, at most 4 run at once, slow queries beyond are logged
+// without a plan
+func WithExplainSlow(on bool) Option {
+	return func(h *QueryHook) {
+		h.explainSlow = on
+		if on {
+			h.explainSlots = make(chan struct{}, maxConcurrentExplains)
+		} else {
+			h.explainSlots = nil
+		}
+	}
+}
+
+// WithSkipMigrations configures the hook to skip successful queries issued
+// by bun's migration framework: schema changes (CREATE/DROP TABLE/INDEX) and
+// queries touching the migration tables, bun_migrations and
+// bun_migration_locks by default (see WithMigrationTables). Failed queries
+// are still logged
+func WithSkipMigrations(on bool) Option {
+	return func(h *QueryHook) {
+		h.skipMigrations = on
+	}
+}
+
+// WithMigrationTables overrides the tables WithSkipMigrations considers
+// migration bookkeeping
+func WithMigrationTables(tables ...string) Option {
+	return func(h *QueryHook) {
+		h.migrationTables = tables
+	}
+}
+
+// WithSuppressHealthChecks configures the hook to skip successful health
+// check queries, by default "SELECT 1" and "SELECT version()". Queries are
+// compared case insensitively, ignoring extra whitespace and a trailing
+// semicolon. Failed health checks are still logged
+func WithSuppressHealthChecks(on bool) Option {
+	return func(h *QueryHook) {
+		h.skipHealthChecks = on
+	}
+}
+
+// WithHealthCheckQueries overrides the queries skipped by
+// WithSuppressHealthChecks
+func WithHealthCheckQueries(queries ...string) Option {
+	return func(h *QueryHook) {
+		h.healthChecks = make(map[string]bool, len(queries))
+		for _, query := range queries {
+			h.healthChecks[normalizeHealthCheck(query)] = true
+		}
+	}
+}
+
+// WithTenantKey configures the hook to add the value stored in the context
+// under ctxKey (eg: a tenant or shard ID) as the fieldName field of every
+// entry, the field is omitted when ctx holds no such value
+func WithTenantKey(ctxKey interface{}, fieldName string) Option {
+	return func(h *QueryHook) {
+		h.fieldExtractors = append(h.fieldExtractors, func(ctx context.Context) logrus.Fields {
+			if v := ctx.Value(ctxKey); v != nil {
+				return logrus.Fields{fieldName: v}
+			}
+			return nil
+		})
+	}
+}
+
+// WithBaggageKeys configures the hook to add the named baggage members of
+// the context as "baggage.<key>" fields, members missing or empty are
+// omitted. The hook doesn't depend on OpenTelemetry, lookup reads a member
+// out of ctx, eg: with go.opentelemetry.io/otel/baggage:
+//
+//	logrusbun.WithBaggageKeys(func(ctx context.Context, key string) string {
+//		return baggage.FromContext(ctx).Member(key).Value()
+//	}, "tenant", "request.origin")
+func WithBaggageKeys(lookup func(ctx context.Context, key string) string, keys ...string) Option {
+	return func(h *QueryHook) {
+		h.fieldExtractors = append(h.fieldExtractors, func(ctx context.Context) logrus.Fields {
+			var fields logrus.Fields
+			for _, key := range keys {
+				if v := lookup(ctx, key); v != "" {
+					if fields == nil {
+						fields = make(logrus.Fields, len(keys))
+					}
+					fields["baggage."+key] = v
+				}
+			}
+			return fields
+		})
+	}
+}
+
+// WithContextValues configures the hook to add the values stored in the
+// context under keys as fields named after the key's String() (fmt.Sprint
+// for keys without one), eg: with type ctxKey string, ctxKey("request_id").
+// Only string and fmt.Stringer values are added, others are skipped, use
+// WithTenantKey to add a value of another type
+func WithContextValues(keys ...interface{}) Option {
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		if stringer, ok := key.(fmt.Stringer); ok {
+			names[i] = stringer.String()
+		} else {
+			names[i] = fmt.Sprint(key)
+		}
+	}
+	return func(h *QueryHook) {
+		h.fieldExtractors = append(h.fieldExtractors, func(ctx context.Context) logrus.Fields {
+			var fields logrus.Fields
+			for i, key := range keys {
+				var value string
+				switch v := ctx.Value(key).(type) {
+				case string:
+					value = v
+				case fmt.Stringer:
+					value = v.String()
+				default:
+					continue
+				}
+				if fields == nil {
+					fields = make(logrus.Fields, len(keys))
+				}
+				fields[names[i]] = value
+			}
+			return fields
+		})
+	}
+}
+
+// WithResultPreview configures the hook to expose the string representation
+// of up to n rows returned by a SELECT as {{.ResultPreview}}, meant for
+// development. bun doesn't expose results to hooks, rows are read back from
+// the query's model once scanned, so raw queries and queries scanning into
+// other destinations have no preview
+func WithResultPreview(n int) Option {
+	return func(h *QueryHook) {
+		h.resultPreview = n
+	}
+}
+
+// WithArgsString configures the hook to render up to n bound arguments of
+// raw queries with their types as {{.ArgsString}}, eg: [1:int, "foo":string],
+// the count of the remaining ones is reported. Values are replaced by the
+// WithArgRedaction mask and go through WithMaskPatterns and WithDefaultMasking
+// like the query. Queries built with bun's query builder are formatted before
+// they reach the hook and have no arguments to render
+func WithArgsString(n int) Option {
+	return func(h *QueryHook) {
+		h.argsLimit = n
+	}
+}
+
+// WithName tags every entry logged by the hook with a "hook" field, made
+// available to templates as {{.HookName}}, to tell hooks apart when several
+// are attached to the same DB
+func WithName(name string) Option {
+	return func(h *QueryHook) {
+		h.name = name
+	}
+}
+
+// WithEntryDecorator configures fn to be called with the entry about to be
+// logged and the variables it was rendered from. The rendered message is
+// available as entry.Message, fn may add fields or change the message and
+// returns the entry to log, or nil to skip logging the query. vars belongs
+// to fn, which may retain it
+func WithEntryDecorator(fn func(entry *logrus.Entry, vars *LogEntryVars) *logrus.Entry) Option {
+	return func(h *QueryHook) {
+		h.entryDecorator = fn
+	}
+}
+
+// WithStartupSelfTest configures NewQueryHook to render every template
+// against a sample query, the error template with a sample error, and to
+// panic if one fails rather than when a matching query is first logged
+func WithStartupSelfTest(on bool) Option {
+	return func(h *QueryHook) {
+		h.selfTest = on
+	}
+}
+
+// WithEventChannel configures the hook to send a copy of the variables of
+// every entry it logs to ch. Sends never block, events are dropped when ch
+// is full. To consume events without logging them, combine with a
+// WithEntryDecorator returning nil
+func WithEventChannel(ch chan<- LogEntryVars) Option {
+	return func(h *QueryHook) {
+		h.eventChannel = ch
+	}
+}
+
 // FromEnv configures the hook using the environment variable value.
 // For example, WithEnv("BUNDEBUG"):
 //   - BUNDEBUG=0 - disables the hook.
@@ -40,165 +757,1551 @@ func FromEnv(keys ...string) Option {
 	if len(keys) == 0 {
 		keys = []string{"BUNDEBUG"}
 	}
-	return func(h *QueryHook) {
-		for _, key := range keys {
-			if env, ok := os.LookupEnv(key); ok {
-				h.enabled = env != "" && env != "0"
-				h.verbose = env == "2"
-				break
-			}
+	return func(h *QueryHook) {
+		for _, key := range keys {
+			if env, ok := os.LookupEnv(key); ok {
+				h.enabled = env != "" && env != "0"
+				h.verbose = env == "2"
+				break
+			}
+		}
+	}
+}
+
+// FromEnvLevels configures the hook levels from the environment, using
+// logrus level names, eg: FromEnvLevels("BUNDEBUG"):
+//   - BUNDEBUG_QUERY_LEVEL=debug - sets QueryLevel.
+//   - BUNDEBUG_SLOW_LEVEL=warn - sets SlowLevel.
+//   - BUNDEBUG_ERROR_LEVEL=error - sets ErrorLevel.
+//
+// Variables are applied over QueryHookOptions regardless of the option
+// order. Invalid values are reported with a warning and ignored
+func FromEnvLevels(prefix string) Option {
+	if prefix == "" {
+		prefix = "BUNDEBUG"
+	}
+	return func(h *QueryHook) {
+		h.envLevelsPrefix = prefix
+	}
+}
+
+// applyEnvLevels sets the levels configured with FromEnvLevels
+func (h *QueryHook) applyEnvLevels() {
+	for suffix, level := range map[string]*logrus.Level{
+		"_QUERY_LEVEL": &h.opts.QueryLevel,
+		"_SLOW_LEVEL":  &h.opts.SlowLevel,
+		"_ERROR_LEVEL": &h.opts.ErrorLevel,
+	} {
+		key := h.envLevelsPrefix + suffix
+		env, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		parsed, err := logrus.ParseLevel(env)
+		if err != nil {
+			h.opts.Logger.Warnf("logrusbun: ignoring %s: %v", key, err)
+			continue
+		}
+		*level = parsed
+	}
+}
+
+const (
+	defaultMessageTemplate = "{{.Operation}}[{{.Duration}}]: {{.Query}}"
+	defaultErrorTemplate   = "{{.Operation}}[{{.Duration}}]: {{.Query}}: {{.Error}}"
+)
+
+// WithQueryHookOptions allows setting the initial logging options
+// for logrus
+func WithQueryHookOptions(opts QueryHookOptions) Option {
+	return func(h *QueryHook) {
+		if opts.ErrorTemplate == "" {
+			opts.ErrorTemplate = defaultErrorTemplate
+		}
+		if opts.MessageTemplate == "" {
+			opts.MessageTemplate = defaultMessageTemplate
+		}
+		if opts.StructuredMessage == "" {
+			opts.StructuredMessage = "bun.query"
+		}
+		if len(opts.SampleRates) > 0 {
+			rates := make(map[string]float64, len(opts.SampleRates))
+			for op, rate := range opts.SampleRates {
+				rates[strings.ToUpper(op)] = rate
+			}
+			opts.SampleRates = rates
+		}
+		if opts.QueryFieldName == "" {
+			opts.QueryFieldName = "query"
+		}
+		if opts.OperationFieldName == "" {
+			opts.OperationFieldName = "operation"
+		}
+		if opts.DurationFieldName == "" {
+			opts.DurationFieldName = "duration"
+		}
+		if opts.ErrorFieldName == "" {
+			opts.ErrorFieldName = "error"
+		}
+		h.opts = &opts
+		left, right := opts.TemplateDelims[0], opts.TemplateDelims[1]
+		if (left == "") != (right == "") {
+			panic("both template delimiters must be set.")
+		}
+		h.errorTemplate = parseTemplate("ErrorTemplate", h.opts.ErrorTemplate, opts.TemplateDelims)
+		h.messageTemplate = parseTemplate("MessageTemplate", h.opts.MessageTemplate, opts.TemplateDelims)
+		h.levelTemplates = nil
+		for level, text := range opts.LevelTemplates {
+			if h.levelTemplates == nil {
+				h.levelTemplates = make(map[logrus.Level]*compiledTemplate, len(opts.LevelTemplates))
+			}
+			h.levelTemplates[level] = parseTemplate("LevelTemplates."+level.String(), text, opts.TemplateDelims)
+		}
+		h.opts = &opts
+	}
+}
+
+// WithDialectTemplate configures alternative message and error templates
+// for queries of the given dialect (as named by bun: pg, sqlite, mysql5,
+// mysql8), an empty template falls back to the default one
+func WithDialectTemplate(dialect string, message, error string) Option {
+	return func(h *QueryHook) {
+		if h.dialectTemplateSources == nil {
+			h.dialectTemplateSources = make(map[string][2]string)
+		}
+		h.dialectTemplateSources[dialect] = [2]string{message, error}
+	}
+}
+
+// compiledTemplate is a parsed message template, templates made of text
+// only are rendered as their constant text without being executed
+type compiledTemplate struct {
+	*template.Template
+	constant   string
+	isConstant bool
+	// fields holds the LogEntryVars fields the template reads, all when it
+	// passes the vars around as a whole, eg: {{printf "%v" .}}
+	fields    map[string]bool
+	allFields bool
+}
+
+// uses reports whether the template reads the given LogEntryVars field
+func (t *compiledTemplate) uses(field string) bool {
+	return t.allFields || t.fields[field]
+}
+
+// collectFields records the fields read by node in t, dot is the vars
+// unless within the body of a range or with
+func (t *compiledTemplate) collectFields(node parse.Node, dotIsVars bool) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, n := range node.Nodes {
+			t.collectFields(n, dotIsVars)
+		}
+	case *parse.ActionNode:
+		t.collectFields(node.Pipe, dotIsVars)
+	case *parse.IfNode:
+		t.collectBranch(&node.BranchNode, dotIsVars, dotIsVars)
+	case *parse.RangeNode:
+		t.collectBranch(&node.BranchNode, dotIsVars, false)
+	case *parse.WithNode:
+		t.collectBranch(&node.BranchNode, dotIsVars, false)
+	case *parse.TemplateNode:
+		t.collectFields(node.Pipe, dotIsVars)
+	case *parse.PipeNode:
+		if node == nil {
+			return
+		}
+		for _, cmd := range node.Cmds {
+			t.collectFields(cmd, dotIsVars)
+		}
+	case *parse.CommandNode:
+		for _, arg := range node.Args {
+			t.collectFields(arg, dotIsVars)
+		}
+	case *parse.ChainNode:
+		t.collectFields(node.Node, dotIsVars)
+	case *parse.FieldNode:
+		if dotIsVars {
+			t.fields[node.Ident[0]] = true
+		}
+	case *parse.VariableNode:
+		// $ is the vars, other variables hold values of the template itself
+		if node.Ident[0] == "$" {
+			if len(node.Ident) > 1 {
+				t.fields[node.Ident[1]] = true
+			} else {
+				t.allFields = true
+			}
+		}
+	case *parse.DotNode:
+		if dotIsVars {
+			t.allFields = true
+		}
+	}
+}
+
+// collectBranch records the fields read by an if, range or with node, the
+// dot of its body is the vars when bodyDotIsVars is set
+func (t *compiledTemplate) collectBranch(node *parse.BranchNode, dotIsVars, bodyDotIsVars bool) {
+	t.collectFields(node.Pipe, dotIsVars)
+	t.collectFields(node.List, bodyDotIsVars)
+	t.collectFields(node.ElseList, dotIsVars)
+}
+
+// parseTemplate parses a text/template, html/template would escape the
+// comparison operators and quotes of logged queries
+func parseTemplate(name, text string, delims [2]string) *compiledTemplate {
+	tmpl, err := template.New(name).Delims(delims[0], delims[1]).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		panic(err)
+	}
+	compiled := &compiledTemplate{Template: tmpl, fields: make(map[string]bool)}
+	// an empty template has no tree, executing it reports the error
+	if tmpl.Tree == nil {
+		return compiled
+	}
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			compiled.collectFields(t.Tree.Root, true)
+		}
+	}
+	var constant strings.Builder
+	for _, node := range tmpl.Tree.Root.Nodes {
+		text, ok := node.(*parse.TextNode)
+		if !ok {
+			return compiled
+		}
+		constant.Write(text.Text)
+	}
+	compiled.constant, compiled.isConstant = constant.String(), true
+	return compiled
+}
+
+// QueryHookOptions logging options
+type QueryHookOptions struct {
+	LogSlow           time.Duration
+	Logger            logrus.FieldLogger
+	ErrorLogger       logrus.FieldLogger
+	LevelLoggers      map[logrus.Level]logrus.FieldLogger
+	QueryLevel        logrus.Level
+	SlowLevel         logrus.Level
+	ErrorLevel        logrus.Level
+	SlowErrorLevel    logrus.Level
+	RetryLevel        logrus.Level
+	SQLStateLevels    map[string]logrus.Level
+	NoRowsLevel       logrus.Level
+	CanceledLevel     logrus.Level
+	LargeResultRows   int
+	LargeResultLevel  logrus.Level
+	MessageTemplate   string
+	ErrorTemplate     string
+	LevelTemplates    map[logrus.Level]string
+	TemplateDelims    [2]string
+	StructuredMessage string
+	MaxFieldLength    int
+
+	// fraction of successful queries logged, 0 (unset) logs them all.
+	// SampleRates overrides it per operation, where 0 is a rate and logs
+	// none of the operation, operations missing from it use SampleRate
+	SampleRate  float64
+	SampleRates map[string]float64
+
+	// field names used with WithStructuredFields, default to query,
+	// operation, duration and error
+	QueryFieldName     string
+	OperationFieldName string
+	DurationFieldName  string
+	ErrorFieldName     string
+}
+
+// QueryHook wraps query hook
+type QueryHook struct {
+	// accessed atomically, kept first for 64-bit alignment on 32-bit platforms
+	seq   uint64
+	stats stats
+
+	enabled           bool
+	verbose           bool
+	queryID           bool
+	fingerprint       bool
+	fingerprintCtx    bool
+	clock             func() time.Time
+	rng               *rand.Rand
+	rngMu             sync.Mutex
+	writer            io.Writer
+	queryFormatters   []func(string) string
+	queryRedactors    []func(string) string
+	queryTransforms   []func(string) string
+	slowFullQuery     bool
+	cancellationGrace bool
+	canceledAfter     time.Duration
+	allowTermination  bool
+	traceSampled      func(context.Context) (bool, bool)
+	traceSampling     float64
+	structured        bool
+	errorFieldName    string
+	nestedQueryField  string
+	maxLevel          logrus.Level
+	goroutineID       bool
+	eventFilter       func(context.Context, *bun.QueryEvent) bool
+	sessionID         func(context.Context, *bun.QueryEvent) string
+	dedup             *dedup
+	onError           func(error)
+	compactSep        string
+	argMask           string
+	prettyPrint       bool
+	logSlots          chan struct{}
+	durationBuckets   *durationBuckets
+	durationTiers     durationTiers
+	sequence          bool
+	levelRemap        map[logrus.Level]logrus.Level
+	rateLimit         *tokenBucket
+	queryRateLimit    *queryRateLimit
+	errorsBypassRate  bool
+	explainSlow       bool
+	explainSlots      chan struct{}
+	tablesUsed        bool
+	columnsUsed       bool
+	skipMigrations    bool
+	migrationTables   []string
+	fieldExtractors   []func(context.Context) logrus.Fields
+	resultPreview     int
+	argsLimit         int
+	envLevelsPrefix   string
+	entryDecorator    func(*logrus.Entry, *LogEntryVars) *logrus.Entry
+	name              string
+	errorBackoff      *errorBackoff
+	errorOnce         *errorOnce
+	errorOnceTTL      time.Duration
+	deadlineFraction  float64
+	deadlineLevel     logrus.Level
+	queryAllowlist    *regexp.Regexp
+	missingWhereLevel logrus.Level
+	eventChannel      chan<- LogEntryVars
+	slowStack         int
+	moduleAttribution bool
+	modulePrefix      string
+	moduleCache       sync.Map
+	selfTest          bool
+	shortOperation    bool
+	operationAliases  map[string]string
+	healthChecks      map[string]bool
+	skipHealthChecks  bool
+	opts              *QueryHookOptions
+	errorTemplate     *compiledTemplate
+	messageTemplate   *compiledTemplate
+	levelTemplates    map[logrus.Level]*compiledTemplate
+
+	dialectTemplateSources map[string][2]string
+	dialectTemplates       map[string]dialectTemplates
+}
+
+type dialectTemplates struct {
+	message *compiledTemplate
+	error   *compiledTemplate
+}
+
+// LogEntryVars variables made available t otemplate
+type LogEntryVars struct {
+	Timestamp        time.Time
+	Query            string
+	QueryBytes       int
+	Operation        string
+	Duration         time.Duration
+	DurationBucket   string
+	Tier             string
+	Error            error
+	Success          bool
+	Slow             bool
+	Level            logrus.Level
+	QueryID          string
+	Fingerprint      string
+	IsBulk           bool
+	BatchSize        int
+	RowsReturned     int
+	Schema           string
+	Table            string
+	Tables           []string
+	Columns          []string
+	Relation         string
+	RelationDepth    int
+	GID              uint64
+	Seq              uint64
+	Plan             string
+	ResultPreview    []string
+	ArgsString       string
+	Name             string
+	TxID             string
+	CacheStatus      string
+	SessionID        string
+	Dialect          string
+	HookName         string
+	Occurrences      uint64
+	DeadlinePressure float64
+	Stack            string
+	Module           string
+	// IntendedLevel is the level an entry logged at ErrorLevel instead of
+	// FatalLevel or PanicLevel resolved to, see WithAllowProcessTermination
+	IntendedLevel string
+	// MissingWhere is set for single UPDATE and DELETE statements without a
+	// WHERE clause of their own, requires WithWarnMissingWhere
+	MissingWhere bool
+	// IsolationMismatch describes the difference between the isolation
+	// levels set with WithExpectedIsolation and WithTxIsolation, eg:
+	// "expected Serializable, got Read Committed"
+	IsolationMismatch string
+
+	// Timestamp as seconds and milliseconds since the Unix epoch
+	TimestampUnix       int64
+	TimestampUnixMillis int64
+
+	// WaitDuration is the time spent acquiring a connection and ExecDuration
+	// the time spent running the query. bun doesn't report when the
+	// connection was acquired, WaitDuration is zero and ExecDuration matches
+	// Duration until it does
+	WaitDuration time.Duration
+	ExecDuration time.Duration
+
+	// Event is the raw bun event, an escape hatch for advanced templates.
+	// Its fields follow bun's versioning and may change between releases
+	Event *bun.QueryEvent
+}
+
+// NewQueryHook returns new instance
+func NewQueryHook(options ...Option) *QueryHook {
+	h := &QueryHook{
+		durationBuckets: defaultDurationBuckets,
+		migrationTables: []string{"bun_migrations", "bun_migration_locks"},
+		healthChecks:    map[string]bool{"select 1": true, "select version()": true},
+	}
+
+	for _, opt := range options {
+		opt(h)
+	}
+
+	if h.opts == nil {
+		panic("logrus settings not set.")
+	}
+	// the global source isn't seeded before go 1.20, sampling and query IDs
+	// would repeat across processes
+	if h.rng == nil {
+		h.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	for dialect, sources := range h.dialectTemplateSources {
+		templates := dialectTemplates{
+			message: h.messageTemplate,
+			error:   h.errorTemplate,
+		}
+		if sources[0] != "" {
+			templates.message = parseTemplate("MessageTemplate."+dialect, sources[0], h.opts.TemplateDelims)
+		}
+		if sources[1] != "" {
+			templates.error = parseTemplate("ErrorTemplate."+dialect, sources[1], h.opts.TemplateDelims)
+		}
+		if h.dialectTemplates == nil {
+			h.dialectTemplates = make(map[string]dialectTemplates)
+		}
+		h.dialectTemplates[dialect] = templates
+	}
+
+	// parsed out of the query, only when something reads them
+	h.tablesUsed = h.usesVar("Tables")
+	h.columnsUsed = h.usesVar("Columns")
+
+	if h.writer != nil {
+		h.opts.Logger = &logrus.Logger{
+			Out:       h.writer,
+			Formatter: new(logrus.TextFormatter),
+			Hooks:     make(logrus.LevelHooks),
+			// levels are resolved by the hook, let everything through
+			Level:    logrus.TraceLevel,
+			ExitFunc: os.Exit,
+		}
+	}
+
+	if h.envLevelsPrefix != "" {
+		h.applyEnvLevels()
+	}
+	if h.errorFieldName != "" {
+		h.opts.ErrorFieldName = h.errorFieldName
+	}
+
+	if h.selfTest {
+		if err := h.selfTestTemplates(); err != nil {
+			panic(err)
+		}
+	}
+
+	return h
+}
+
+// usesVar reports whether the given LogEntryVars field may be read once an
+// entry is built: by a template, as a structured field, or by the entry
+// decorator and event channel consumers, which get all of them
+func (h *QueryHook) usesVar(field string) bool {
+	if h.structured || h.entryDecorator != nil || h.eventChannel != nil {
+		return true
+	}
+	templates := []*compiledTemplate{h.messageTemplate, h.errorTemplate}
+	for _, tmpl := range h.levelTemplates {
+		templates = append(templates, tmpl)
+	}
+	for _, dialect := range h.dialectTemplates {
+		templates = append(templates, dialect.message, dialect.error)
+	}
+	for _, tmpl := range templates {
+		if tmpl.uses(field) {
+			return true
+		}
+	}
+	return false
+}
+
+// selfTestTemplates renders the default, dialect and level templates
+// against a sample query
+func (h *QueryHook) selfTestTemplates() error {
+	event := &bun.QueryEvent{Query: "SELECT 1", StartTime: h.now()}
+	vars := LogEntryVars{
+		Timestamp:      event.StartTime,
+		Query:          event.Query,
+		Operation:      "SELECT",
+		Duration:       time.Millisecond,
+		ExecDuration:   time.Millisecond,
+		DurationBucket: h.durationBuckets.label(time.Millisecond),
+		Table:          "table",
+		Tables:         []string{"table"},
+		HookName:       h.name,
+		Event:          event,
+	}
+	dialects := []string{""}
+	for dialect := range h.dialectTemplates {
+		dialects = append(dialects, dialect)
+	}
+	for _, dialect := range dialects {
+		vars.Dialect = dialect
+		vars.Error, vars.Success = nil, true
+		if _, err := h.renderVars(&vars, false); err != nil {
+			return fmt.Errorf("logrusbun: self test: %w", err)
+		}
+		vars.Error, vars.Success = errors.New("self test"), false
+		if _, err := h.renderVars(&vars, true); err != nil {
+			return fmt.Errorf("logrusbun: self test: %w", err)
+		}
+	}
+	vars.Dialect = ""
+	for level := range h.levelTemplates {
+		vars.Level = level
+		if _, err := h.renderVars(&vars, true); err != nil {
+			return fmt.Errorf("logrusbun: self test: %w", err)
+		}
+	}
+	return nil
+}
+
+// String summarizes the effective configuration of the hook, eg:
+// logrusbun.QueryHook{enabled: true, verbose: false, query: debug, slow: warning >100ms, error: error, templates: default}
+func (h *QueryHook) String() string {
+	return h.describe(false)
+}
+
+// GoString is String including the templates source
+func (h *QueryHook) GoString() string {
+	return h.describe(true)
+}
+
+func (h *QueryHook) describe(templates bool) string {
+	var b strings.Builder
+	b.WriteString("logrusbun.QueryHook{enabled: ")
+	b.WriteString(strconv.FormatBool(h.enabled))
+	b.WriteString(", verbose: ")
+	b.WriteString(strconv.FormatBool(h.verbose))
+	if h.name != "" {
+		b.WriteString(", name: ")
+		b.WriteString(h.name)
+	}
+	if h.opts == nil {
+		b.WriteString("}")
+		return b.String()
+	}
+	level := func(name string, level logrus.Level) {
+		b.WriteString(", ")
+		b.WriteString(name)
+		b.WriteString(": ")
+		if level == 0 {
+			b.WriteString("off")
+		} else {
+			b.WriteString(level.String())
+		}
+	}
+	level("query", h.opts.QueryLevel)
+	level("slow", h.opts.SlowLevel)
+	if h.opts.LogSlow > 0 {
+		b.WriteString(" >")
+		b.WriteString(h.opts.LogSlow.String())
+	}
+	level("error", h.opts.ErrorLevel)
+	if h.maxLevel != 0 {
+		level("max", h.maxLevel)
+	}
+	b.WriteString(", templates: ")
+	switch {
+	case templates:
+		b.WriteString(strconv.Quote(h.opts.MessageTemplate))
+		b.WriteString(" ")
+		b.WriteString(strconv.Quote(h.opts.ErrorTemplate))
+	case h.opts.MessageTemplate == defaultMessageTemplate && h.opts.ErrorTemplate == defaultErrorTemplate:
+		b.WriteString("default")
+	default:
+		b.WriteString("custom")
+	}
+	if len(h.dialectTemplates) > 0 {
+		b.WriteString(" +dialects")
+	}
+	if len(h.levelTemplates) > 0 {
+		b.WriteString(" +levels")
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// BeforeQuery stashes a generated query ID and the query fingerprint in the
+// context when enabled, or when an event filter may force the query to be
+// logged
+func (h *QueryHook) BeforeQuery(ctx context.Context, event *bun.QueryEvent) context.Context {
+	if !h.enabled && h.eventFilter == nil {
+		return ctx
+	}
+	setLastQuery(ctx, event)
+	if h.queryID {
+		ctx = context.WithValue(ctx, queryIDKey, newQueryID(h.randUint64()))
+	}
+	if h.fingerprintCtx {
+		ctx = context.WithValue(ctx, fingerprintKey, queryFingerprint(event.Query))
+	}
+	return ctx
+}
+
+// LogPanic logs recovered, a value returned by recover(), at ErrorLevel,
+// subject to WithMaxLevel and WithLevelRemap, with the error template, along with the last query started with ctx,
+// which must have been prepared with WithLastQuery. It ties panics raised
+// while a query is in flight, eg: when scanning rows, back to the query:
+//
+//	ctx = logrusbun.WithLastQuery(ctx)
+//	defer func() {
+//		if r := recover(); r != nil {
+//			hook.LogPanic(ctx, r)
+//			panic(r)
+//		}
+//	}()
+//
+// The query is redacted and formatted like the logged ones, the event
+// filter and query allowlist apply
+func (h *QueryHook) LogPanic(ctx context.Context, recovered interface{}) {
+	event := lastQueryFromContext(ctx)
+	var forced bool
+	if h.eventFilter != nil && event != nil {
+		if !h.eventFilter(ctx, event) {
+			return
+		}
+		forced = true
+	}
+	if !h.enabled && !forced {
+		return
+	}
+	if h.queryAllowlist != nil && event != nil && !h.queryAllowlist.MatchString(event.Query) {
+		return
+	}
+
+	level, intendedLevel := h.clampLevel(logrus.ErrorLevel)
+	logger := h.logger(level, true)
+	if !isLevelEnabled(logger, level) {
+		return
+	}
+
+	args := &LogEntryVars{
+		Timestamp: h.now(),
+		Error:     fmt.Errorf("panic: %v", recovered),
+		Level:     level,
+		QueryID:   QueryIDFromContext(ctx),
+		Name:      QueryNameFromContext(ctx),
+		TxID:      TxIDFromContext(ctx),
+		HookName:  h.name,
+	}
+	if event != nil {
+		args.Query = h.transformQuery(event, true)
+		args.Operation = eventOperation(event)
+		args.Dialect = eventDialect(event)
+		args.Event = event
+		if !event.StartTime.IsZero() {
+			args.Duration = args.Timestamp.Sub(event.StartTime)
+		}
+	}
+	if level != intendedLevel {
+		args.IntendedLevel = intendedLevel.String()
+	}
+	logger = logger.WithField("panic", recovered)
+	if args.IntendedLevel != "" {
+		logger = logger.WithField("intended_level", args.IntendedLevel)
+	}
+	if h.structured {
+		logAt(logger.WithFields(h.entryFields(args)), level, h.opts.StructuredMessage)
+		return
+	}
+	logAt(logger, level, h.render(args, true))
+}
+
+// AfterQuery convert a bun QueryEvent into a logrus message
+func (h *QueryHook) AfterQuery(ctx context.Context, event *bun.QueryEvent) {
+	var forced bool
+	if h.eventFilter != nil {
+		if !h.eventFilter(ctx, event) {
+			return
+		}
+		forced = true
+	}
+	if !h.enabled && !forced {
+		return
+	}
+	if h.queryAllowlist != nil && !h.queryAllowlist.MatchString(event.Query) {
+		return
+	}
+
+	now := h.now()
+	var dur time.Duration
+	// a malformed event without a start time would yield a bogus duration
+	if !event.StartTime.IsZero() {
+		dur = now.Sub(event.StartTime)
+	}
+	h.stats.record(event, dur, h.redactQuery)
+
+	rowsReturned, rowsKnown := eventRowsReturned(event)
+	isLarge := h.opts.LargeResultRows > 0 && h.opts.LargeResultLevel != 0 &&
+		rowsKnown && rowsReturned >= h.opts.LargeResultRows
+	pressure := h.deadlinePressure(ctx, event, dur)
+	isPressured := pressure > 0 && isSuccess(event.Err)
+	// shared by the query parsers, tokenized on first use
+	tokens := queryTokens{query: event.Query}
+	isMissingWhere := h.missingWhereLevel != 0 && tokens.missingWhere()
+	mismatch := isolationMismatch(ctx)
+	tier := h.durationTiers.match(dur)
+
+	if !forced && !h.isVerbose(ctx) {
+		switch event.Err {
+		case sql.ErrNoRows:
+			if h.opts.NoRowsLevel == 0 {
+				return
+			}
+		case nil:
+			if !isLarge && !isPressured && !isMissingWhere && mismatch == "" {
+				return
+			}
+		case sql.ErrTxDone:
+			return
+		}
+	}
+	if h.skipMigrations && isSuccess(event.Err) && h.isMigrationQuery(event) {
+		return
+	}
+	if h.skipHealthChecks && isSuccess(event.Err) && h.healthChecks[normalizeHealthCheck(event.Query)] {
+		return
+	}
+	if h.canceledAfter > 0 && dur >= h.canceledAfter && event.Err != nil && h.isCanceled(ctx, event.Err) {
+		return
+	}
+
+	var level logrus.Level
+	var isError, isEscalated bool
+	isSlow := h.opts.LogSlow > 0 && dur >= h.opts.LogSlow
+
+	switch {
+	case event.Err == sql.ErrNoRows && h.opts.NoRowsLevel != 0:
+		// rendered with the error template to show what wasn't found
+		isError = true
+		level = h.opts.NoRowsLevel
+	case event.Err == nil, event.Err == sql.ErrNoRows:
+		isError = false
+		if isSlow {
+			level = h.opts.SlowLevel
+		} else {
+			level = h.opts.QueryLevel
+		}
+		if tier != nil && tier.Level != 0 {
+			// a tier more severe than regular queries escalates them past sampling
+			isEscalated = h.opts.QueryLevel == 0 || tier.Level < h.opts.QueryLevel
+			level = tier.Level
+		}
+		// flag oversized results unless already logged more severely
+		if isLarge && (level == 0 || h.opts.LargeResultLevel < level) {
+			level = h.opts.LargeResultLevel
+		}
+		if isPressured && (level == 0 || h.deadlineLevel < level) {
+			level = h.deadlineLevel
+		}
+	default:
+		isError = true
+		if h.opts.CanceledLevel != 0 && h.isCanceled(ctx, event.Err) {
+			level = h.opts.CanceledLevel
+		} else if h.opts.RetryLevel != 0 && isRetryableAttempt(ctx) && isRetryableError(event.Err) {
+			level = h.opts.RetryLevel
+		} else if stateLevel, ok := sqlStateLevel(h.opts.SQLStateLevels, event.Err); ok {
+			level = stateLevel
+		} else if isSlow && h.opts.SlowErrorLevel != 0 {
+			level = h.opts.SlowErrorLevel
+		} else {
+			level = h.opts.ErrorLevel
+		}
+	}
+	if isMissingWhere && (level == 0 || h.missingWhereLevel < level) {
+		level = h.missingWhereLevel
+	}
+	if mismatch != "" && (level == 0 || logrus.WarnLevel < level) {
+		level = logrus.WarnLevel
+	}
+	if level == 0 {
+		return
+	}
+
+	var fingerprint string
+	if h.fingerprint || h.queryRateLimit != nil || h.errorOnce != nil || h.errorBackoff != nil || h.dedup != nil {
+		if fingerprint = FingerprintFromContext(ctx); fingerprint == "" {
+			fingerprint = queryFingerprint(event.Query)
+		}
+	}
+	// known errors are demoted before the level is clamped, remapped and
+	// routed like any other
+	var occurrences uint64
+	if h.errorOnce != nil && isError {
+		key := errorSQLState(event.Err)
+		if key == "" && event.Err != nil {
+			key = event.Err.Error()
+		}
+		if count := h.errorOnce.check(fingerprint+"\x00"+key, now); count > 1 {
+			level = logrus.DebugLevel
+			occurrences = count
 		}
 	}
-}
 
-// WithQueryHookOptions allows setting the initial logging options
-// for logrus
-func WithQueryHookOptions(opts QueryHookOptions) Option {
-	return func(h *QueryHook) {
-		if opts.ErrorTemplate == "" {
-			opts.ErrorTemplate = "{{.Operation}}[{{.Duration}}]: {{.Query}}: {{.Error}}"
+	level, intendedLevel := h.clampLevel(level)
+	// skip rendering entries the logger would discard anyway
+	if !isLevelEnabled(h.logger(level, isError), level) {
+		return
+	}
+
+	if !isError && !isSlow && !isEscalated && !isLarge && !isPressured && !isMissingWhere && mismatch == "" && !h.sampled(event) {
+		return
+	}
+
+	if h.rateLimit != nil && !isError && !h.rateLimit.allow(now) {
+		h.stats.drop()
+		return
+	}
+
+	if h.queryRateLimit != nil && !(isError && h.errorsBypassRate) && !h.queryRateLimit.allow(fingerprint, now) {
+		h.stats.drop()
+		return
+	}
+
+	if h.logSlots != nil {
+		select {
+		case h.logSlots <- struct{}{}:
+			defer func() { <-h.logSlots }()
+		default:
+			h.stats.drop()
+			return
 		}
-		if opts.MessageTemplate == "" {
-			opts.MessageTemplate = "{{.Operation}}[{{.Duration}}]: {{.Query}}"
+	}
+
+	query := h.transformQuery(event, isSlow)
+
+	operation := eventOperation(event)
+	batchSize := eventBatchSize(event, operation)
+	schema, table := eventTable(event)
+	args := &LogEntryVars{
+		Timestamp:    now,
+		Query:        query,
+		Operation:    operation,
+		Duration:     dur,
+		ExecDuration: dur,
+		Error:        event.Err,
+		QueryID:      QueryIDFromContext(ctx),
+		Name:         QueryNameFromContext(ctx),
+		TxID:         TxIDFromContext(ctx),
+		Dialect:      eventDialect(event),
+		HookName:     h.name,
+		Event:        event,
+		IsBulk:       batchSize > 1,
+		BatchSize:    batchSize,
+		RowsReturned: rowsReturned,
+		Schema:       schema,
+		Table:        table,
+	}
+	args.DurationBucket = h.durationBuckets.label(dur)
+	if h.tablesUsed {
+		args.Tables = tokens.tables()
+	}
+	if h.columnsUsed {
+		args.Columns = tokens.columns()
+	}
+	args.Relation, args.RelationDepth = eventRelation(event)
+	if tier != nil {
+		args.Tier = tier.Name
+	}
+	// no rows is a success, even when logged with the error template
+	args.Success = isSuccess(event.Err)
+	args.Slow = isSlow
+	args.QueryBytes = len(event.Query)
+	args.CacheStatus = CacheStatusFromContext(ctx)
+	args.TimestampUnix = now.Unix()
+	args.TimestampUnixMillis = now.UnixNano() / int64(time.Millisecond)
+	if alias, ok := h.operationAliases[strings.ToUpper(operation)]; ok {
+		args.Operation = alias
+	} else if h.shortOperation {
+		args.Operation = abbreviateOperation(operation)
+	}
+	if h.fingerprint {
+		args.Fingerprint = fingerprint
+	}
+	args.Occurrences = occurrences
+	if h.goroutineID {
+		args.GID = goroutineID()
+	}
+	if h.sessionID != nil {
+		args.SessionID = h.sessionID(ctx, event)
+	}
+	if isPressured {
+		args.DeadlinePressure = pressure
+	}
+	args.MissingWhere = isMissingWhere
+	args.IsolationMismatch = mismatch
+	args.Level = level
+	if level != intendedLevel {
+		args.IntendedLevel = intendedLevel.String()
+	}
+	if h.slowStack > 0 && isSlow {
+		args.Stack = callerStack(h.slowStack)
+	}
+	if h.moduleAttribution {
+		args.Module = callerModule(h.modulePrefix, &h.moduleCache)
+	}
+	if h.resultPreview > 0 && !isError {
+		args.ResultPreview = resultPreview(event, h.resultPreview)
+	}
+	if h.argsLimit > 0 && len(event.QueryArgs) > 0 {
+		args.ArgsString = formatArgs(event.QueryArgs, h.argsLimit, h.argMask)
+		for _, redact := range h.queryRedactors {
+			args.ArgsString = redact(args.ArgsString)
 		}
-		h.opts = &opts
-		errorTemplate, err := template.New("ErrorTemplate").Parse(h.opts.ErrorTemplate)
-		if err != nil {
-			panic(err)
+	}
+
+	if h.dedup != nil {
+		skip, ended := h.dedup.check(fingerprint, level, isError)
+		if skip {
+			return
 		}
-		messageTemplate, err := template.New("MessageTemplate").Parse(h.opts.MessageTemplate)
-		if err != nil {
-			panic(err)
+		h.logRepeats(ended)
+	}
+
+	if h.errorBackoff != nil && isError {
+		errMsg := ""
+		if event.Err != nil {
+			errMsg = event.Err.Error()
+		}
+		count, ok := h.errorBackoff.check(fingerprint + "\x00" + errMsg)
+		if !ok {
+			return
 		}
+		args.Occurrences = count
+	}
 
-		h.errorTemplate = errorTemplate
-		h.messageTemplate = messageTemplate
-		h.opts = &opts
+	// numbered once known to be logged, not to leave gaps
+	if h.sequence {
+		args.Seq = atomic.AddUint64(&h.seq, 1)
+	}
+
+	if h.explainSlow && isSlow && !isError && explainable(event) {
+		select {
+		case h.explainSlots <- struct{}{}:
+			plan, err := explain(event)
+			<-h.explainSlots
+			if err != nil && h.onError != nil {
+				h.onError(err)
+			}
+			args.Plan = plan
+		default:
+		}
+	}
+
+	if h.eventChannel != nil {
+		select {
+		case h.eventChannel <- *args:
+		default:
+		}
+	}
+
+	var msg string
+	logger := h.logger(level, isError)
+	switch {
+	case h.compactSep != "":
+		logger = logger.WithField("q", compactValue(h.compactSep, args, event))
+	case h.structured:
+		msg = h.opts.StructuredMessage
+		logger = logger.WithFields(h.entryFields(args))
+	default:
+		msg = h.render(args, isError)
 	}
+	if fields := h.contextFields(ctx); len(fields) > 0 {
+		logger = logger.WithFields(fields)
+	}
+
+	h.log(logger, level, msg, args)
 }
 
-// QueryHookOptions logging options
-type QueryHookOptions struct {
-	LogSlow         time.Duration
-	Logger          logrus.FieldLogger
-	QueryLevel      logrus.Level
-	SlowLevel       logrus.Level
-	ErrorLevel      logrus.Level
-	MessageTemplate string
-	ErrorTemplate   string
+// clampLevel applies WithMaxLevel, WithLevelRemap and
+// WithAllowProcessTermination to a resolved level, returning the level to
+// log at and the one intended before the termination guard
+func (h *QueryHook) clampLevel(level logrus.Level) (logrus.Level, logrus.Level) {
+	if level < h.maxLevel {
+		level = h.maxLevel
+	}
+	if remapped, ok := h.levelRemap[level]; ok {
+		level = remapped
+	}
+	// Fatal exits and Panic panics, only on explicit request
+	intended := level
+	if level <= logrus.FatalLevel && !h.allowTermination {
+		level = logrus.ErrorLevel
+	}
+	return level, intended
 }
 
-// QueryHook wraps query hook
-type QueryHook struct {
-	enabled         bool
-	verbose         bool
-	opts            *QueryHookOptions
-	errorTemplate   *template.Template
-	messageTemplate *template.Template
+// log logs msg at level, passing the entry through the configured decorator
+func (h *QueryHook) log(logger logrus.FieldLogger, level logrus.Level, msg string, args *LogEntryVars) {
+	if h.name != "" {
+		logger = logger.WithField("hook", h.name)
+	}
+	if args.Occurrences > 0 {
+		logger = logger.WithField("occurrences", args.Occurrences)
+	}
+	if args.DeadlinePressure > 0 {
+		logger = logger.WithField("deadline_pressure", args.DeadlinePressure)
+	}
+	if args.MissingWhere {
+		logger = logger.WithField("missing_where", true)
+	}
+	if args.IsolationMismatch != "" {
+		logger = logger.WithField("isolation_mismatch", args.IsolationMismatch)
+	}
+	if args.Tier != "" {
+		logger = logger.WithField("tier", args.Tier)
+	}
+	// slow failures are logged at an error level, keep them visible to slow
+	// query monitoring
+	if args.Slow && !args.Success {
+		logger = logger.WithField("slow", true)
+	}
+	// nested in the query field otherwise
+	if args.Fingerprint != "" && (!h.structured || h.nestedQueryField == "") {
+		logger = logger.WithField("fingerprint", args.Fingerprint)
+	}
+	if args.Stack != "" {
+		logger = logger.WithField("stack", args.Stack)
+	}
+	if args.Module != "" {
+		logger = logger.WithField("module", args.Module)
+	}
+	if args.IntendedLevel != "" {
+		logger = logger.WithField("intended_level", args.IntendedLevel)
+	}
+	if h.entryDecorator == nil {
+		logAt(logger, level, msg)
+		return
+	}
+	entry := logger.WithFields(nil)
+	entry.Message = msg
+	if entry = h.entryDecorator(entry, args); entry == nil {
+		return
+	}
+	logAt(entry, level, entry.Message)
 }
 
-// LogEntryVars variables made available t otemplate
-type LogEntryVars struct {
-	Timestamp time.Time
-	Query     string
-	Operation string
-	Duration  time.Duration
-	Error     error
+// logRepeats logs the number of entries a run of repeats skipped with
+// WithDeduplicateConsecutive, through the logger of the run's level
+func (h *QueryHook) logRepeats(run dedupRun) {
+	if run.repeats == 0 {
+		return
+	}
+	logAt(h.logger(run.level, run.isError), run.level, fmt.Sprintf("previous query repeated %d times", run.repeats))
 }
 
-// NewQueryHook returns new instance
-func NewQueryHook(options ...Option) *QueryHook {
-	h := new(QueryHook)
+// Flush logs the pending count of repeats skipped with
+// WithDeduplicateConsecutive, otherwise only logged once a different query
+// comes in. It is called by LogSummary
+func (h *QueryHook) Flush() {
+	if h.dedup != nil {
+		h.logRepeats(h.dedup.flush())
+	}
+}
 
-	for _, opt := range options {
-		opt(h)
+// deadlinePressure returns the fraction of the time left before the ctx
+// deadline at the start of the query that it used, when over the configured
+// fraction, or 0
+func (h *QueryHook) deadlinePressure(ctx context.Context, event *bun.QueryEvent, dur time.Duration) float64 {
+	if h.deadlineLevel == 0 || event.StartTime.IsZero() {
+		return 0
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	remaining := deadline.Sub(event.StartTime)
+	if remaining <= 0 {
+		return 0
 	}
+	used := float64(dur) / float64(remaining)
+	if used < h.deadlineFraction {
+		return 0
+	}
+	return used
+}
 
-	if h.opts == nil {
-		panic("logrus settings not set.")
+// transformQuery returns the query to log, transformed in stages, each
+// running its transforms in the order their options were given:
+//  1. redact: WithArgRedaction, then WithMaskPatterns and WithDefaultMasking
+//  2. normalize: WithSanitizeInClauses, skipped for slow queries with
+//     WithSlowFullQuery
+//  3. WithQueryTransforms
+//  4. format: WithPrettyPrint
+func (h *QueryHook) transformQuery(event *bun.QueryEvent, isSlow bool) string {
+	query := h.redactQuery(event)
+	if !isSlow || !h.slowFullQuery {
+		for _, format := range h.queryFormatters {
+			query = format(query)
+		}
+	}
+	for _, transform := range h.queryTransforms {
+		query = transform(query)
+	}
+	if h.prettyPrint {
+		query = prettyPrint(query)
+	}
+	return query
+}
+
+// redactQuery returns the query of event with the redaction stage of
+// transformQuery applied
+func (h *QueryHook) redactQuery(event *bun.QueryEvent) string {
+	query := event.Query
+	if h.argMask != "" {
+		query = redactArgs(event, h.argMask)
 	}
+	for _, redact := range h.queryRedactors {
+		query = redact(query)
+	}
+	return query
+}
 
-	return h
+// contextFields returns the fields extracted from ctx by the configured
+// extractors
+func (h *QueryHook) contextFields(ctx context.Context) logrus.Fields {
+	var fields logrus.Fields
+	for _, extract := range h.fieldExtractors {
+		for k, v := range extract(ctx) {
+			if fields == nil {
+				fields = make(logrus.Fields)
+			}
+			fields[k] = v
+		}
+	}
+	return fields
 }
 
-// BeforeQuery does nothing tbh
-func (h *QueryHook) BeforeQuery(ctx context.Context, event *bun.QueryEvent) context.Context {
-	return ctx
+// logger returns the logger configured for level, the error logger for
+// entries rendered with the error template when isError is set, or the
+// main logger
+func (h *QueryHook) logger(level logrus.Level, isError bool) logrus.FieldLogger {
+	if logger := h.opts.LevelLoggers[level]; logger != nil {
+		return logger
+	}
+	if isError && h.opts.ErrorLogger != nil {
+		return h.opts.ErrorLogger
+	}
+	return h.opts.Logger
 }
 
-// AfterQuery convert a bun QueryEvent into a logrus message
-func (h *QueryHook) AfterQuery(ctx context.Context, event *bun.QueryEvent) {
-	if !h.enabled {
-		return
+// isLevelEnabled reports whether logger emits entries at level, loggers not
+// exposing their level are assumed to
+func isLevelEnabled(logger logrus.FieldLogger, level logrus.Level) bool {
+	switch logger := logger.(type) {
+	case *logrus.Logger:
+		return logger.IsLevelEnabled(level)
+	case *logrus.Entry:
+		return logger.Logger.IsLevelEnabled(level)
+	case interface{ IsLevelEnabled(logrus.Level) bool }:
+		return logger.IsLevelEnabled(level)
 	}
+	return true
+}
 
-	if !h.verbose {
-		switch event.Err {
-		case nil, sql.ErrNoRows, sql.ErrTxDone:
-			return
+// RenderVars executes the hook's message template, or its error template
+// when isError is set, against vars. It renders stored query metadata the
+// same way the hook renders live events, vars.Dialect selects the templates
+// configured with WithDialectTemplate and vars.Level those configured with
+// QueryHookOptions.LevelTemplates
+func (h *QueryHook) RenderVars(vars LogEntryVars, isError bool) (string, error) {
+	return h.renderVars(&vars, isError)
+}
+
+func (h *QueryHook) renderVars(vars *LogEntryVars, isError bool) (string, error) {
+	tmpl := h.messageTemplate
+	if isError {
+		tmpl = h.errorTemplate
+	}
+	if templates, ok := h.dialectTemplates[vars.Dialect]; ok {
+		tmpl = templates.message
+		if isError {
+			tmpl = templates.error
 		}
 	}
-	var level logrus.Level
-	var isError bool
+	if levelTmpl, ok := h.levelTemplates[vars.Level]; ok && vars.Level != 0 {
+		tmpl = levelTmpl
+	}
+	if tmpl.isConstant {
+		return tmpl.constant, nil
+	}
 	var msg bytes.Buffer
+	if err := tmpl.Execute(&msg, vars); err != nil {
+		return "", err
+	}
+	return msg.String(), nil
+}
 
-	now := time.Now()
-	dur := now.Sub(event.StartTime)
+// render renders args with the hook's templates. Unless an OnError callback
+// is configured, template failures panic
+func (h *QueryHook) render(args *LogEntryVars, isError bool) string {
+	msg, err := h.renderVars(args, isError)
+	if err != nil {
+		if h.onError == nil {
+			panic(err)
+		}
+		h.onError(err)
+		return fallbackMessage(args)
+	}
+	return msg
+}
 
-	switch event.Err {
-	case nil, sql.ErrNoRows:
-		isError = false
-		if h.opts.LogSlow > 0 && dur >= h.opts.LogSlow {
-			level = h.opts.SlowLevel
-		} else {
-			level = h.opts.QueryLevel
+// compactValue joins operation, duration, rows affected and error with sep,
+// backslashes and occurrences of sep within a value are backslash escaped
+func compactValue(sep string, args *LogEntryVars, event *bun.QueryEvent) string {
+	var rows, errMsg string
+	if n, ok := eventRowsAffected(event); ok {
+		rows = strconv.FormatInt(n, 10)
+	}
+	if args.Error != nil {
+		errMsg = args.Error.Error()
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, sep, `\`+sep)
+	return strings.Join([]string{
+		escaper.Replace(args.Operation),
+		escaper.Replace(args.Duration.String()),
+		rows,
+		escaper.Replace(errMsg),
+	}, sep)
+}
+
+// fallbackMessage is logged when a template fails to render
+func fallbackMessage(args *LogEntryVars) string {
+	if args.Error != nil {
+		return fmt.Sprintf("%s[%s]: %s: %s", args.Operation, args.Duration, args.Query, args.Error)
+	}
+	return fmt.Sprintf("%s[%s]: %s", args.Operation, args.Duration, args.Query)
+}
+
+// logAt logs msg at level, exiting for FatalLevel and panicking for
+// PanicLevel like the matching logger methods do
+func logAt(logger logrus.FieldLogger, level logrus.Level, msg string) {
+	entry, ok := logger.(*logrus.Entry)
+	if !ok {
+		entry = logger.WithFields(nil)
+	}
+	entry.Log(level, msg)
+	if level == logrus.FatalLevel && entry.Logger.IsLevelEnabled(level) {
+		entry.Logger.Exit(1)
+	}
+}
+
+// entryFields returns the structured fields of args, with the query details
+// nested as configured with WithNestedQueryField
+func (h *QueryHook) entryFields(args *LogEntryVars) logrus.Fields {
+	fields := structuredFields(h.opts, args)
+	if h.nestedQueryField == "" {
+		return fields
+	}
+	// already truncated to MaxFieldLength
+	query := map[string]interface{}{
+		"text":      fields[h.opts.QueryFieldName],
+		"operation": fields[h.opts.OperationFieldName],
+		"bytes":     args.QueryBytes,
+	}
+	if args.Fingerprint != "" {
+		query["fingerprint"] = args.Fingerprint
+	}
+	if table, ok := fields["table"]; ok {
+		query["table"] = table
+	}
+	for _, key := range []string{h.opts.QueryFieldName, h.opts.OperationFieldName, "table", "query_bytes"} {
+		delete(fields, key)
+	}
+	fields[h.nestedQueryField] = query
+	return fields
+}
+
+// structuredFields returns the logrus fields attached in structured mode
+func structuredFields(opts *QueryHookOptions, args *LogEntryVars) logrus.Fields {
+	fields := logrus.Fields{
+		opts.QueryFieldName:     args.Query,
+		opts.OperationFieldName: args.Operation,
+		opts.DurationFieldName:  args.Duration,
+	}
+	if args.QueryBytes != 0 {
+		fields["query_bytes"] = args.QueryBytes
+	}
+	if args.TimestampUnixMillis != 0 {
+		fields["ts_unix"] = args.TimestampUnix
+		fields["ts_unix_ms"] = args.TimestampUnixMillis
+	}
+	if args.DurationBucket != "" {
+		fields["duration_bucket"] = args.DurationBucket
+	}
+
+	if args.Table != "" {
+		fields["table"] = args.Table
+	}
+	if args.Schema != "" {
+		fields["schema"] = args.Schema
+	}
+	if len(args.Tables) > 0 {
+		fields["tables"] = args.Tables
+	}
+	if len(args.Columns) > 0 {
+		fields["columns"] = args.Columns
+	}
+	if args.Relation != "" {
+		fields["relation"] = args.Relation
+		fields["relation_depth"] = args.RelationDepth
+	}
+	if args.Name != "" {
+		fields["name"] = args.Name
+	}
+	if args.TxID != "" {
+		fields["tx_id"] = args.TxID
+	}
+	if args.CacheStatus != "" {
+		fields["cache_status"] = args.CacheStatus
+	}
+	if args.SessionID != "" {
+		fields["session_id"] = args.SessionID
+	}
+	if args.QueryID != "" {
+		fields["query_id"] = args.QueryID
+	}
+	if args.GID != 0 {
+		fields["gid"] = args.GID
+	}
+	if args.Seq != 0 {
+		fields["seq"] = args.Seq
+	}
+	if args.Plan != "" {
+		fields["plan"] = args.Plan
+	}
+	if len(args.ResultPreview) > 0 {
+		fields["result_preview"] = args.ResultPreview
+	}
+	if args.ArgsString != "" {
+		fields["args"] = args.ArgsString
+	}
+	if args.Error != nil {
+		fields[opts.ErrorFieldName] = args.Error.Error()
+		fields["error_type"] = fmt.Sprintf("%T", args.Error)
+		if code := errorSQLState(args.Error); code != "" {
+			fields["error_code"] = code
 		}
-	default:
-		isError = true
-		level = h.opts.ErrorLevel
 	}
-	if level == 0 {
-		return
+	if opts.MaxFieldLength > 0 {
+		for k, v := range fields {
+			if v, ok := v.(string); ok {
+				fields[k] = truncateField(v, opts.MaxFieldLength)
+			}
+		}
+	}
+	return fields
+}
+
+// truncateField cuts s to at most max bytes, on a rune boundary, marking
+// the truncation with a trailing "..."
+func truncateField(s string, max int) string {
+	if len(s) <= max {
+		return s
 	}
+	end := max
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end] + "..."
+}
 
-	args := &LogEntryVars{
-		Timestamp: now,
-		Query:     string(event.Query),
-		Operation: eventOperation(event),
-		Duration:  dur,
-		Error:     event.Err,
+// goroutineID parses the current goroutine ID out of runtime.Stack, this is
+// slow and only meant for debugging
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if idx := bytes.IndexByte(b, ' '); idx > 0 {
+		b = b[:idx]
 	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
 
-	if isError {
-		if err := h.errorTemplate.Execute(&msg, args); err != nil {
-			panic(err)
+// newQueryID formats a random number as a short identifier, it is not meant
+// to be globally unique, only unique enough to pair log lines
+func newQueryID(n uint64) string {
+	return fmt.Sprintf("%016x", n)
+}
+
+// now returns the current time from the clock set with WithClock
+func (h *QueryHook) now() time.Time {
+	if h.clock != nil {
+		return h.clock()
+	}
+	return time.Now()
+}
+
+// randFloat64 draws from the hook's source, see WithRand
+func (h *QueryHook) randFloat64() float64 {
+	h.rngMu.Lock()
+	defer h.rngMu.Unlock()
+	return h.rng.Float64()
+}
+
+// randUint64 draws from the hook's source, see WithRand
+func (h *QueryHook) randUint64() uint64 {
+	h.rngMu.Lock()
+	defer h.rngMu.Unlock()
+	return h.rng.Uint64()
+}
+
+// isSuccess reports whether err denotes a successful query
+func isSuccess(err error) bool {
+	return err == nil || err == sql.ErrNoRows
+}
+
+// isMigrationQuery reports whether the event is a schema change or touches
+// one of the migration tables
+func (h *QueryHook) isMigrationQuery(event *bun.QueryEvent) bool {
+	switch eventOperation(event) {
+	case "CREATE TABLE", "DROP TABLE", "CREATE INDEX", "DROP INDEX":
+		return true
+	}
+	for _, table := range queryTables(event.Query) {
+		_, table = splitTableName(table)
+		for _, migrationTable := range h.migrationTables {
+			if table == migrationTable {
+				return true
+			}
 		}
-	} else {
-		if err := h.messageTemplate.Execute(&msg, args); err != nil {
-			panic(err)
+	}
+	return false
+}
+
+// normalizeHealthCheck lowercases query, collapses whitespace and trims a
+// trailing semicolon
+func normalizeHealthCheck(query string) string {
+	if len(query) > 64 {
+		// longer than any sensible health check, skip the work
+		return ""
+	}
+	query = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(query), ";"))
+	return strings.ToLower(strings.Join(strings.Fields(query), " "))
+}
+
+// sampled reports whether a successful query falls within the sample rate
+// of its operation
+func (h *QueryHook) sampled(event *bun.QueryEvent) bool {
+	rate, ok := 0.0, false
+	if len(h.opts.SampleRates) > 0 {
+		rate, ok = h.opts.SampleRates[strings.ToUpper(eventOperation(event))]
+	}
+	if !ok {
+		if h.opts.SampleRate == 0 {
+			return true
 		}
+		rate = h.opts.SampleRate
 	}
+	return rate >= 1 || h.randFloat64() < rate
+}
 
-	switch level {
-	case logrus.DebugLevel:
-		h.opts.Logger.Debug(msg.String())
-	case logrus.InfoLevel:
-		h.opts.Logger.Info(msg.String())
-	case logrus.WarnLevel:
-		h.opts.Logger.Warn(msg.String())
-	case logrus.ErrorLevel:
-		h.opts.Logger.Error(msg.String())
-	case logrus.FatalLevel:
-		h.opts.Logger.Fatal(msg.String())
-	case logrus.PanicLevel:
-		h.opts.Logger.Panic(msg.String())
-	default:
-		panic(fmt.Errorf("Unsupported level: %v", level))
+// isCanceled reports whether err results from the query's context being
+// canceled
+func (h *QueryHook) isCanceled(ctx context.Context, err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return true
+	}
+	return h.cancellationGrace && ctx.Err() != nil
+}
+
+// isVerbose reports whether successful queries should be logged, following
+// the trace sampling decision when one is available
+func (h *QueryHook) isVerbose(ctx context.Context) bool {
+	if h.traceSampled != nil {
+		if sampled, ok := h.traceSampled(ctx); ok {
+			return sampled
+		}
+	}
+	if h.traceSampling > 0 {
+		return sampleTrace(TraceIDFromContext(ctx), h.traceSampling, h.randFloat64)
 	}
+	return h.verbose
+}
 
+// sampleTrace reports whether the trace identified by traceID falls within
+// rate, consistently for a given ID. Without an ID the decision is drawn
+// from random
+func sampleTrace(traceID string, rate float64, random func() float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if traceID == "" {
+		return random() < rate
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(traceID))
+	// FNV barely mixes the high bits of short inputs, finish it with the
+	// murmur3 finalizer for sequential IDs to spread evenly
+	sum := hash.Sum64()
+	sum ^= sum >> 33
+	sum *= 0xff51afd7ed558ccd
+	sum ^= sum >> 33
+	sum *= 0xc4ceb9fe1a85ec53
+	sum ^= sum >> 33
+	return float64(sum)/math.MaxUint64 < rate
 }
 
-// taken from bun
+// eventDialect returns the name of the event's bun dialect, eg: pg
+func eventDialect(event *bun.QueryEvent) string {
+	if event.DB == nil || event.DB.Dialect() == nil {
+		return ""
+	}
+	return event.DB.Dialect().Name().String()
+}
+
+// taken from bun. Statements prepared with bun.DB.PrepareContext go straight
+// to database/sql without notifying hooks, only SQL level PREPARE, EXECUTE
+// and DEALLOCATE statements are seen, labeled by their first word
 func eventOperation(event *bun.QueryEvent) string {
 	switch event.QueryAppender.(type) {
 	case *bun.SelectQuery:
@@ -213,10 +2316,39 @@ func eventOperation(event *bun.QueryEvent) string {
 		return "CREATE TABLE"
 	case *bun.DropTableQuery:
 		return "DROP TABLE"
+	case *bun.CreateIndexQuery:
+		return "CREATE INDEX"
+	case *bun.DropIndexQuery:
+		return "DROP INDEX"
 	}
 	return queryOperation(event.Query)
 }
 
+// operationAbbreviations maps operations to the codes logged with
+// WithAbbreviatedOperation
+var operationAbbreviations = map[string]string{
+	"SELECT":       "S",
+	"INSERT":       "I",
+	"UPDATE":       "U",
+	"DELETE":       "D",
+	"CREATE TABLE": "CT",
+	"DROP TABLE":   "DT",
+	"CREATE INDEX": "CI",
+	"DROP INDEX":   "DI",
+	"BEGIN":        "B",
+	"COMMIT":       "C",
+	"ROLLBACK":     "R",
+}
+
+// abbreviateOperation returns the code of operation, or operation when it
+// has none
+func abbreviateOperation(operation string) string {
+	if code, ok := operationAbbreviations[strings.ToUpper(operation)]; ok {
+		return code
+	}
+	return operation
+}
+
 // taken from bun
 func queryOperation(name string) string {
 	if idx := strings.Index(name, " "); idx > 0 {
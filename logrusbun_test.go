@@ -1,26 +1,70 @@
 package logrusbun
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/oiime/logrusbun/logrusbuntest"
 	"github.com/sirupsen/logrus"
 	"github.com/uptrace/bun"
 )
 
 func TestLogging(t *testing.T) {
-	var log = &logrus.Logger{
-		Formatter: &testFormatter{
-			cb: func(*logrus.Entry) ([]byte, error) {
-				return nil, nil
-			},
-		},
-		Level: logrus.DebugLevel,
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:     log,
+			LogSlow:    time.Second,
+			QueryLevel: logrus.DebugLevel,
+			SlowLevel:  logrus.WarnLevel,
+			ErrorLevel: logrus.ErrorLevel,
+		}),
+	)
+
+	tests := []struct {
+		event   *bun.QueryEvent
+		level   logrus.Level
+		message string
+	}{
+		{logrusbuntest.NewQueryEvent("SELECT 1", nil, 0), logrus.DebugLevel, "SELECT[*]: SELECT 1"},
+		{logrusbuntest.NewQueryEvent("SELECT 1", sql.ErrNoRows, 0), logrus.DebugLevel, "SELECT[*]: SELECT 1"},
+		{logrusbuntest.NewQueryEvent("SELECT pg_sleep(2)", nil, 2*time.Second), logrus.WarnLevel, "SELECT[*]: SELECT pg_sleep(2)"},
+		{logrusbuntest.NewQueryEvent("SELEC 1", errors.New("syntax error"), 0), logrus.ErrorLevel, "SELEC[*]: SELEC 1: syntax error"},
+	}
+	for _, test := range tests {
+		recorder.Reset()
+		hook.AfterQuery(context.Background(), test.event)
+		entry, ok := recorder.Last()
+		if !ok {
+			t.Errorf("%s: expected an entry", test.event.Query)
+			continue
+		}
+		if entry.Level != test.level {
+			t.Errorf("%s: expected level %v, got %v", test.event.Query, test.level, entry.Level)
+		}
+		if message := durationPattern.ReplaceAllString(entry.Message, "[*]"); message != test.message {
+			t.Errorf("%s: expected message %q, got %q", test.event.Query, test.message, message)
+		}
 	}
-	db := bun.DB{}
-	db.AddQueryHook(NewQueryHook(WithQueryHookOptions(QueryHookOptions{Logger: log})))
-	// @TODO against empty db (stub?)
 }
 
+var durationPattern = regexp.MustCompile(`\[[^\]]*\]`)
+
 type testFormatter struct {
 	cb func(*logrus.Entry) ([]byte, error)
 }
@@ -64,3 +108,2228 @@ func TestReadmeQueryHook(t *testing.T) {
 		WithQueryHookOptions(QueryHookOptions{Logger: log}),
 	))
 }
+
+func newCaptureLogger(entries *[]logrus.Entry) *logrus.Logger {
+	return &logrus.Logger{
+		Out: ioutil.Discard,
+		Formatter: &testFormatter{
+			cb: func(e *logrus.Entry) ([]byte, error) {
+				*entries = append(*entries, *e)
+				return nil, nil
+			},
+		},
+		Hooks: make(logrus.LevelHooks),
+		Level: logrus.TraceLevel,
+	}
+}
+
+func TestQueryID(t *testing.T) {
+	var entries []logrus.Entry
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryID(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:          newCaptureLogger(&entries),
+			QueryLevel:      logrus.DebugLevel,
+			MessageTemplate: "{{.QueryID}}",
+		}),
+	)
+	event := &bun.QueryEvent{Query: "SELECT 1", StartTime: time.Now()}
+	ctx := hook.BeforeQuery(context.Background(), event)
+	id := QueryIDFromContext(ctx)
+	if id == "" {
+		t.Fatal("expected a query id in context")
+	}
+	hook.AfterQuery(ctx, event)
+	if len(entries) != 1 || entries[0].Message != id {
+		t.Fatalf("expected message %q, got %v", id, entries)
+	}
+}
+
+func TestPropagateFingerprint(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithPropagateFingerprint(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:          log,
+			QueryLevel:      logrus.DebugLevel,
+			MessageTemplate: "{{.Fingerprint}}",
+		}),
+	)
+	event := logrusbuntest.NewQueryEvent("SELECT * FROM users WHERE id = 1", nil, 0)
+	ctx := hook.BeforeQuery(context.Background(), event)
+	fp := FingerprintFromContext(ctx)
+	if fp == "" || fp != queryFingerprint("SELECT * FROM users WHERE id = 2") {
+		t.Fatalf("expected the query fingerprint in context, got %q", fp)
+	}
+	hook.AfterQuery(ctx, event)
+	entry, ok := recorder.Last()
+	if !ok || entry.Message != fp || entry.Data["fingerprint"] != fp {
+		t.Fatalf("expected fingerprint %q in message and fields, got %v", fp, entry)
+	}
+
+	hook = NewQueryHook(
+		WithEnabled(true),
+		WithFingerprint(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log}),
+	)
+	if ctx := hook.BeforeQuery(context.Background(), event); FingerprintFromContext(ctx) != "" {
+		t.Error("expected the fingerprint not to be propagated")
+	}
+}
+
+func TestClockAndRand(t *testing.T) {
+	start := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	run := func() []string {
+		log, recorder := logrusbuntest.NewLogger()
+		hook := NewQueryHook(
+			WithEnabled(true),
+			WithVerbose(true),
+			WithQueryID(true),
+			WithClock(func() time.Time { return start.Add(2 * time.Second) }),
+			WithRand(rand.New(rand.NewSource(1))),
+			WithQueryHookOptions(QueryHookOptions{
+				Logger:          log,
+				LogSlow:         time.Second,
+				QueryLevel:      logrus.DebugLevel,
+				SlowLevel:       logrus.WarnLevel,
+				SampleRate:      0.5,
+				MessageTemplate: "{{.QueryID}} {{.Duration}} {{.TimestampUnix}}",
+			}),
+		)
+		for i := 0; i < 20; i++ {
+			event := &bun.QueryEvent{Query: "SELECT 1", StartTime: start.Add(time.Duration(i) * 100 * time.Millisecond)}
+			hook.AfterQuery(hook.BeforeQuery(context.Background(), event), event)
+		}
+		var messages []string
+		for _, entry := range recorder.Entries() {
+			messages = append(messages, entry.Level.String()+" "+entry.Message)
+		}
+		return messages
+	}
+
+	first, second := run(), run()
+	if strings.Join(first, "\n") != strings.Join(second, "\n") {
+		t.Errorf("expected identical runs, got %q and %q", first, second)
+	}
+	// queries started within a second of the clock are fast and sampled
+	slow := 0
+	for _, message := range first {
+		if strings.HasPrefix(message, "warning ") {
+			slow++
+		}
+		if !strings.HasSuffix(message, " "+strconv.FormatInt(start.Unix()+2, 10)) {
+			t.Errorf("expected the clock's timestamp, got %q", message)
+		}
+	}
+	if slow != 11 || len(first) == 20 {
+		t.Errorf("expected 11 slow queries and some fast ones sampled out, got %d slow out of %d", slow, len(first))
+	}
+}
+
+func TestPerQueryRateLimit(t *testing.T) {
+	for _, bypass := range []bool{false, true} {
+		log, recorder := logrusbuntest.NewLogger()
+		hook := NewQueryHook(
+			WithEnabled(true),
+			WithVerbose(true),
+			WithPerQueryRateLimit(2),
+			WithErrorsBypassPerQueryRateLimit(bypass),
+			WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel, ErrorLevel: logrus.ErrorLevel}),
+		)
+		for i := 0; i < 5; i++ {
+			hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT * FROM hot WHERE id = "+strconv.Itoa(i), nil, 0))
+		}
+		hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT * FROM cold WHERE id = 1", nil, 0))
+		for i := 0; i < 3; i++ {
+			hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT * FROM hot WHERE id = 1", errors.New("boom"), 0))
+		}
+		want := 3
+		if bypass {
+			want = 6
+		}
+		if recorder.Len() != want || hook.Summary().Dropped != uint64(9-want) {
+			t.Errorf("bypass %v: expected %d entries, got %d entries and %d drops", bypass, want, recorder.Len(), hook.Summary().Dropped)
+		}
+	}
+}
+
+func TestWithWriter(t *testing.T) {
+	var buf bytes.Buffer
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithWriter(&buf),
+		WithQueryHookOptions(QueryHookOptions{QueryLevel: logrus.InfoLevel}),
+	)
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: "SELECT 1", StartTime: time.Now()})
+	if !strings.Contains(buf.String(), "SELECT 1") {
+		t.Fatalf("expected query in output, got %q", buf.String())
+	}
+}
+
+func TestTraceSampled(t *testing.T) {
+	type sampledKey struct{}
+	var entries []logrus.Entry
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithTraceSampled(func(ctx context.Context) (bool, bool) {
+			sampled, ok := ctx.Value(sampledKey{}).(bool)
+			return sampled, ok
+		}),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:     newCaptureLogger(&entries),
+			QueryLevel: logrus.DebugLevel,
+			ErrorLevel: logrus.ErrorLevel,
+		}),
+	)
+	event := &bun.QueryEvent{Query: "SELECT 1", StartTime: time.Now()}
+	hook.AfterQuery(context.Background(), event)
+	hook.AfterQuery(context.WithValue(context.Background(), sampledKey{}, false), event)
+	if len(entries) != 0 {
+		t.Fatalf("expected no entries, got %d", len(entries))
+	}
+	hook.AfterQuery(context.WithValue(context.Background(), sampledKey{}, true), event)
+	if len(entries) != 1 {
+		t.Fatalf("expected sampled query to be logged, got %d entries", len(entries))
+	}
+	event.Err = errors.New("boom")
+	hook.AfterQuery(context.WithValue(context.Background(), sampledKey{}, false), event)
+	if len(entries) != 2 || entries[1].Level != logrus.ErrorLevel {
+		t.Fatalf("expected error to be logged regardless of sampling, got %v", entries)
+	}
+}
+
+type testSQLStateError string
+
+func (e testSQLStateError) Error() string    { return "sqlstate " + string(e) }
+func (e testSQLStateError) SQLState() string { return string(e) }
+
+func TestRetryLevel(t *testing.T) {
+	var entries []logrus.Entry
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:     newCaptureLogger(&entries),
+			ErrorLevel: logrus.ErrorLevel,
+			RetryLevel: logrus.DebugLevel,
+		}),
+	)
+	event := &bun.QueryEvent{
+		Query:     "UPDATE t SET a = 1",
+		StartTime: time.Now(),
+		Err:       fmt.Errorf("wrapped: %w", testSQLStateError("40001")),
+	}
+	hook.AfterQuery(WithRetryableAttempt(context.Background()), event)
+	hook.AfterQuery(context.Background(), event)
+	event.Err = testSQLStateError("42601")
+	hook.AfterQuery(WithRetryableAttempt(context.Background()), event)
+
+	want := []logrus.Level{logrus.DebugLevel, logrus.ErrorLevel, logrus.ErrorLevel}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(entries))
+	}
+	for i, level := range want {
+		if entries[i].Level != level {
+			t.Errorf("entry %d: expected level %v, got %v", i, level, entries[i].Level)
+		}
+	}
+}
+
+func TestSQLStateLevels(t *testing.T) {
+	var entries []logrus.Entry
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:         newCaptureLogger(&entries),
+			ErrorLevel:     logrus.ErrorLevel,
+			SQLStateLevels: map[string]logrus.Level{"40001": logrus.WarnLevel},
+		}),
+	)
+	event := &bun.QueryEvent{
+		Query:     "UPDATE t SET a = 1",
+		StartTime: time.Now(),
+		Err:       fmt.Errorf("wrapped: %w", testSQLStateError("40001")),
+	}
+	hook.AfterQuery(context.Background(), event)
+	event.Err = testSQLStateError("42601")
+	hook.AfterQuery(context.Background(), event)
+	event.Err = errors.New("no code")
+	hook.AfterQuery(context.Background(), event)
+
+	want := []logrus.Level{logrus.WarnLevel, logrus.ErrorLevel, logrus.ErrorLevel}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(entries))
+	}
+	for i, level := range want {
+		if entries[i].Level != level {
+			t.Errorf("entry %d: expected level %v, got %v", i, level, entries[i].Level)
+		}
+	}
+}
+
+func TestSlowErrors(t *testing.T) {
+	for _, test := range []struct {
+		slowErrorLevel logrus.Level
+		want           logrus.Level
+	}{
+		{0, logrus.ErrorLevel},
+		{logrus.WarnLevel, logrus.WarnLevel},
+	} {
+		log, recorder := logrusbuntest.NewLogger()
+		hook := NewQueryHook(
+			WithEnabled(true),
+			WithQueryHookOptions(QueryHookOptions{
+				Logger:         log,
+				LogSlow:        time.Second,
+				ErrorLevel:     logrus.ErrorLevel,
+				SlowErrorLevel: test.slowErrorLevel,
+			}),
+		)
+		hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", errors.New("boom"), 0))
+		hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 2", errors.New("boom"), 2*time.Second))
+		entries := recorder.Entries()
+		if len(entries) != 2 {
+			t.Fatalf("expected 2 entries, got %d", len(entries))
+		}
+		if _, ok := entries[0].Data["slow"]; ok || entries[0].Level != logrus.ErrorLevel {
+			t.Errorf("expected a fast failure at error without the slow field, got %v %v", entries[0].Level, entries[0].Data)
+		}
+		if entries[1].Data["slow"] != true || entries[1].Level != test.want {
+			t.Errorf("expected a slow failure at %v with the slow field, got %v %v", test.want, entries[1].Level, entries[1].Data)
+		}
+	}
+}
+
+func TestErrorOnceThenQuiet(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithErrorOnceThenQuiet(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, ErrorLevel: logrus.ErrorLevel}),
+	)
+	ctx := context.Background()
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("UPDATE t SET a = 1", testSQLStateError("40001"), 0))
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("UPDATE t SET a = 2", testSQLStateError("40001"), 0))
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("UPDATE t SET a = 3", testSQLStateError("23505"), 0))
+
+	entries := recorder.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	if entries[0].Level != logrus.ErrorLevel || entries[2].Level != logrus.ErrorLevel {
+		t.Errorf("expected first occurrences at error, got %v and %v", entries[0].Level, entries[2].Level)
+	}
+	if entries[1].Level != logrus.DebugLevel || entries[1].Data["occurrences"] != uint64(2) {
+		t.Errorf("expected the repeated error at debug with a count, got %v %v", entries[1].Level, entries[1].Data)
+	}
+
+	// the demoted level is remapped and routed like any other
+	log, recorder = logrusbuntest.NewLogger()
+	infoLog, infoRecorder := logrusbuntest.NewLogger()
+	hook = NewQueryHook(
+		WithEnabled(true),
+		WithErrorOnceThenQuiet(true),
+		WithLevelRemap(map[logrus.Level]logrus.Level{logrus.DebugLevel: logrus.InfoLevel}),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:       log,
+			LevelLoggers: map[logrus.Level]logrus.FieldLogger{logrus.InfoLevel: infoLog},
+			ErrorLevel:   logrus.ErrorLevel,
+		}),
+	)
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("UPDATE t SET a = 1", testSQLStateError("40001"), 0))
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("UPDATE t SET a = 2", testSQLStateError("40001"), 0))
+	if recorder.Len() != 1 {
+		t.Errorf("expected only the first occurrence on the main logger, got %v", recorder.Entries())
+	}
+	if entry, ok := infoRecorder.Last(); !ok || entry.Level != logrus.InfoLevel || entry.Data["occurrences"] != uint64(2) {
+		t.Errorf("expected the repeated error remapped to info on its logger, got %v", infoRecorder.Entries())
+	}
+}
+
+func TestErrorBackoffFingerprint(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithErrorBackoff(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, ErrorLevel: logrus.ErrorLevel}),
+	)
+	for i := 1; i <= 16; i++ {
+		query := fmt.Sprintf("SELECT * FROM t WHERE id = %d", i)
+		hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent(query, errors.New("boom"), 0))
+	}
+	var counts []interface{}
+	for _, entry := range recorder.Entries() {
+		counts = append(counts, entry.Data["occurrences"])
+	}
+	want := []interface{}{uint64(1), uint64(2), uint64(4), uint64(8), uint64(16)}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("expected queries differing by their values to back off, got occurrences %v", counts)
+	}
+}
+
+func TestNoRowsLevel(t *testing.T) {
+	var entries []logrus.Entry
+	options := QueryHookOptions{
+		Logger:     newCaptureLogger(&entries),
+		QueryLevel: logrus.DebugLevel,
+		ErrorLevel: logrus.ErrorLevel,
+	}
+	event := &bun.QueryEvent{Query: "SELECT 1", StartTime: time.Now(), Err: sql.ErrNoRows}
+
+	NewQueryHook(WithEnabled(true), WithQueryHookOptions(options)).AfterQuery(context.Background(), event)
+	if len(entries) != 0 {
+		t.Fatalf("expected no rows to be skipped by default, got %d entries", len(entries))
+	}
+
+	options.NoRowsLevel = logrus.WarnLevel
+	NewQueryHook(WithEnabled(true), WithQueryHookOptions(options)).AfterQuery(context.Background(), event)
+	if len(entries) != 1 || entries[0].Level != logrus.WarnLevel {
+		t.Fatalf("expected a warning entry, got %v", entries)
+	}
+	if !strings.Contains(entries[0].Message, sql.ErrNoRows.Error()) {
+		t.Errorf("expected the error template to be used, got %q", entries[0].Message)
+	}
+}
+
+func TestStructuredErrorFields(t *testing.T) {
+	var entries []logrus.Entry
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithStructuredFields(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:     newCaptureLogger(&entries),
+			ErrorLevel: logrus.ErrorLevel,
+		}),
+	)
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{
+		Query:     "SELEC 1",
+		StartTime: time.Now(),
+		Err:       testSQLStateError("42601"),
+	})
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	data := entries[0].Data
+	if data["query"] != "SELEC 1" || data["error"] != "sqlstate 42601" || data["error_code"] != "42601" {
+		t.Errorf("unexpected fields: %v", data)
+	}
+	if data["error_type"] != "logrusbun.testSQLStateError" {
+		t.Errorf("unexpected error_type: %v", data["error_type"])
+	}
+	if entries[0].Message != "bun.query" {
+		t.Errorf("expected the structured message, got %q", entries[0].Message)
+	}
+}
+
+func TestNestedQueryField(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithStructuredFields(true),
+		WithFingerprint(true),
+		WithNestedQueryField("sql"),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel}),
+	)
+	query := "SELECT * FROM users WHERE id = 1"
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent(query, nil, 0))
+	entry, _ := recorder.Last()
+	nested, ok := entry.Data["sql"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected a nested sql field, got %v", entry.Data)
+	}
+	want := map[string]interface{}{
+		"text":        query,
+		"operation":   "SELECT",
+		"bytes":       len(query),
+		"fingerprint": queryFingerprint(query),
+	}
+	if !reflect.DeepEqual(nested, want) {
+		t.Errorf("expected %v, got %v", want, nested)
+	}
+	for _, key := range []string{"query", "operation", "query_bytes", "fingerprint"} {
+		if _, ok := entry.Data[key]; ok {
+			t.Errorf("expected no top level %s field, got %v", key, entry.Data)
+		}
+	}
+	if _, ok := entry.Data["duration"]; !ok {
+		t.Errorf("expected the duration to stay at the top level, got %v", entry.Data)
+	}
+}
+
+func TestMaxLevel(t *testing.T) {
+	var entries []logrus.Entry
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithMaxLevel(logrus.InfoLevel),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:     newCaptureLogger(&entries),
+			QueryLevel: logrus.DebugLevel,
+			ErrorLevel: logrus.ErrorLevel,
+		}),
+	)
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: "SELECT 1", StartTime: time.Now()})
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: "SELECT 1", StartTime: time.Now(), Err: errors.New("boom")})
+	if len(entries) != 2 || entries[0].Level != logrus.DebugLevel || entries[1].Level != logrus.InfoLevel {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+}
+
+func TestGoroutineID(t *testing.T) {
+	a, b := goroutineID(), make(chan uint64)
+	go func() { b <- goroutineID() }()
+	if other := <-b; a == 0 || other == 0 || a == other {
+		t.Fatalf("expected distinct non zero ids, got %d and %d", a, other)
+	}
+}
+
+func TestZeroStartTime(t *testing.T) {
+	var entries []logrus.Entry
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:          newCaptureLogger(&entries),
+			QueryLevel:      logrus.DebugLevel,
+			MessageTemplate: "{{.Duration}}",
+		}),
+	)
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: "SELECT 1"})
+	if len(entries) != 1 || entries[0].Message != "0s" {
+		t.Fatalf("expected a zero duration, got %v", entries)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	var entries []logrus.Entry
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: newCaptureLogger(&entries)}),
+	)
+	now := time.Now()
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: "SELECT 1", StartTime: now.Add(-time.Millisecond)})
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: "SELECT 2", StartTime: now.Add(-time.Hour)})
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: "SELECT 3", StartTime: now, Err: errors.New("boom")})
+
+	s := hook.Summary()
+	if s.Queries != 3 || s.Errors != 1 || s.SlowestQuery != "SELECT 2" || s.TotalDuration < time.Hour {
+		t.Fatalf("unexpected summary: %+v", s)
+	}
+
+	hook.LogSummary(logrus.InfoLevel)
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Message, "3 queries, 1 errors, 0 dropped") {
+		t.Fatalf("unexpected summary entry: %v", entries)
+	}
+
+	entries = nil
+	hook = NewQueryHook(
+		WithEnabled(true),
+		WithStructuredFields(true),
+		WithDefaultMasking(),
+		WithQueryHookOptions(QueryHookOptions{Logger: newCaptureLogger(&entries)}),
+	)
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: "UPDATE users SET password = 'hunter2'", StartTime: now.Add(-time.Hour)})
+	if s := hook.Summary(); s.SlowestQuery != "UPDATE users SET password = ***" {
+		t.Fatalf("expected the slowest query to be masked, got %q", s.SlowestQuery)
+	}
+	hook.LogSummary(logrus.InfoLevel)
+	if len(entries) != 1 || strings.Contains(entries[0].Message, "hunter2") || entries[0].Data["slowest_query"] != "UPDATE users SET password = ***" {
+		t.Fatalf("expected a masked summary entry, got %v", entries)
+	}
+}
+
+func TestQueryName(t *testing.T) {
+	var entries []logrus.Entry
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:          newCaptureLogger(&entries),
+			QueryLevel:      logrus.DebugLevel,
+			MessageTemplate: "{{.Name}}",
+		}),
+	)
+	ctx := WithQueryName(context.Background(), "GetUserByEmail")
+	hook.AfterQuery(ctx, &bun.QueryEvent{Query: "SELECT 1", StartTime: time.Now()})
+	if len(entries) != 1 || entries[0].Message != "GetUserByEmail" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+}
+
+func TestSessionAndTxID(t *testing.T) {
+	type sessionKey struct{}
+	sessionID := WithSessionID(func(ctx context.Context, event *bun.QueryEvent) string {
+		id, _ := ctx.Value(sessionKey{}).(string)
+		return id
+	})
+	ctx := WithTxID(context.WithValue(context.Background(), sessionKey{}, "4242"), "tx-1")
+
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		sessionID,
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel, MessageTemplate: "{{.SessionID}} {{.TxID}}"}),
+	)
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	if entry, _ := recorder.Last(); entry.Message != "4242 tx-1" {
+		t.Errorf("expected the session and transaction IDs, got %q", entry.Message)
+	}
+
+	hook = NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithStructuredFields(true),
+		sessionID,
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel}),
+	)
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	if entry, _ := recorder.Last(); entry.Data["session_id"] != "4242" || entry.Data["tx_id"] != "tx-1" {
+		t.Errorf("expected session_id and tx_id fields, got %v", entry.Data)
+	}
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	if entry, _ := recorder.Last(); entry.Data["session_id"] != nil || entry.Data["tx_id"] != nil {
+		t.Errorf("expected no session_id and tx_id fields without IDs, got %v", entry.Data)
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	var entries []logrus.Entry
+	hook := NewQueryHook(
+		WithEnabled(false),
+		WithEventFilter(func(ctx context.Context, event *bun.QueryEvent) bool {
+			return event.Query != "SELECT 1"
+		}),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:     newCaptureLogger(&entries),
+			QueryLevel: logrus.DebugLevel,
+		}),
+	)
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: "SELECT 1", StartTime: time.Now()})
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: "SELECT 2", StartTime: time.Now()})
+	if len(entries) != 1 || !strings.Contains(entries[0].Message, "SELECT 2") {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+
+	// forced events are prepared by BeforeQuery like enabled ones
+	entries = nil
+	WithQueryID(true)(hook)
+	event := &bun.QueryEvent{Query: "SELECT 3", StartTime: time.Now()}
+	ctx := hook.BeforeQuery(context.Background(), event)
+	hook.AfterQuery(ctx, event)
+	if QueryIDFromContext(ctx) == "" || len(entries) != 1 {
+		t.Fatalf("expected a query ID for the forced event, got %v", entries)
+	}
+}
+
+func TestDeduplicateConsecutive(t *testing.T) {
+	var entries []logrus.Entry
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithDeduplicateConsecutive(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:     newCaptureLogger(&entries),
+			QueryLevel: logrus.DebugLevel,
+		}),
+	)
+	for _, query := range []string{"SELECT 1", "SELECT 1", "SELECT 1", "SELECT 2 FROM t"} {
+		hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: query, StartTime: time.Now()})
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	if entries[1].Message != "previous query repeated 2 times" {
+		t.Errorf("unexpected repeat message: %q", entries[1].Message)
+	}
+	if !strings.Contains(entries[2].Message, "SELECT 2") {
+		t.Errorf("unexpected last message: %q", entries[2].Message)
+	}
+
+	// repeats are matched by fingerprint, numbered without gaps, routed to
+	// the logger of their level and flushed with the summary
+	entries = nil
+	var debugEntries []logrus.Entry
+	hook = NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithSequence(true),
+		WithDeduplicateConsecutive(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:          newCaptureLogger(&entries),
+			LevelLoggers:    map[logrus.Level]logrus.FieldLogger{logrus.DebugLevel: newCaptureLogger(&debugEntries)},
+			QueryLevel:      logrus.DebugLevel,
+			MessageTemplate: "{{.Seq}} {{.Query}}",
+		}),
+	)
+	for _, query := range []string{"SELECT * FROM t WHERE id = 1", "SELECT * FROM t WHERE id = 2", "SELECT * FROM u", "SELECT * FROM v", "SELECT * FROM v"} {
+		hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: query, StartTime: time.Now()})
+	}
+	var messages []string
+	for _, entry := range debugEntries {
+		messages = append(messages, entry.Message)
+	}
+	want := []string{"1 SELECT * FROM t WHERE id = 1", "previous query repeated 1 times", "2 SELECT * FROM u", "3 SELECT * FROM v"}
+	if !reflect.DeepEqual(messages, want) {
+		t.Errorf("expected %q, got %q", want, messages)
+	}
+	hook.LogSummary(logrus.InfoLevel)
+	if len(debugEntries) != 5 || debugEntries[4].Message != "previous query repeated 1 times" {
+		t.Errorf("expected the pending repeats to be flushed, got %v", debugEntries)
+	}
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Message, "5 queries") {
+		t.Errorf("expected only the summary on the main logger, got %v", entries)
+	}
+}
+
+func TestTemplateDelims(t *testing.T) {
+	var entries []logrus.Entry
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:          newCaptureLogger(&entries),
+			QueryLevel:      logrus.DebugLevel,
+			MessageTemplate: "{{literal}} [[.Query]]",
+			ErrorTemplate:   "[[.Error]]",
+			TemplateDelims:  [2]string{"[[", "]]"},
+		}),
+	)
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: "SELECT 1", StartTime: time.Now()})
+	if len(entries) != 1 || entries[0].Message != "{{literal}} SELECT 1" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a single delimiter")
+		}
+	}()
+	NewQueryHook(WithQueryHookOptions(QueryHookOptions{TemplateDelims: [2]string{"[[", ""}}))
+}
+
+func TestOnError(t *testing.T) {
+	var entries []logrus.Entry
+	var hookErr error
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithOnError(func(err error) { hookErr = err }),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:          newCaptureLogger(&entries),
+			QueryLevel:      logrus.DebugLevel,
+			MessageTemplate: "{{.Query.Missing}}",
+		}),
+	)
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: "SELECT 1", StartTime: time.Now()})
+	if hookErr == nil {
+		t.Fatal("expected OnError to be called")
+	}
+	if len(entries) != 1 || !strings.Contains(entries[0].Message, "SELECT 1") {
+		t.Fatalf("expected a fallback entry, got %v", entries)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	var entries []logrus.Entry
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithCompact("|"),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:     newCaptureLogger(&entries),
+			ErrorLevel: logrus.ErrorLevel,
+		}),
+	)
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{
+		Query:         "SELECT 1",
+		QueryAppender: &bun.SelectQuery{},
+		Err:           errors.New(`a|b\c`),
+	})
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	if q := entries[0].Data["q"]; q != `SELECT|0s||a\|b\\c` {
+		t.Errorf("unexpected compact value: %v", q)
+	}
+	// context fields are added to compact entries too
+	type tenantKey struct{}
+	entries = nil
+	WithTenantKey(tenantKey{}, "tenant")(hook)
+	hook.AfterQuery(context.WithValue(context.Background(), tenantKey{}, "acme"), &bun.QueryEvent{Query: "SELECT 1", Err: errors.New("boom")})
+	if len(entries) != 1 || entries[0].Data["tenant"] != "acme" || entries[0].Message != "" {
+		t.Errorf("expected a compact entry with the tenant field, got %v", entries)
+	}
+}
+
+func TestDialectTemplate(t *testing.T) {
+	hook := NewQueryHook(
+		WithDialectTemplate("sqlite", "sqlite: {{.Query}}", ""),
+		WithQueryHookOptions(QueryHookOptions{}),
+	)
+	args := &LogEntryVars{Query: "SELECT 1", Operation: "SELECT", Error: errors.New("boom")}
+	if msg := hook.render(args, false); msg != "SELECT[0s]: SELECT 1" {
+		t.Errorf("unexpected default message: %q", msg)
+	}
+	args.Dialect = "sqlite"
+	if msg := hook.render(args, false); msg != "sqlite: SELECT 1" {
+		t.Errorf("unexpected dialect message: %q", msg)
+	}
+	if msg := hook.render(args, true); msg != "SELECT[0s]: SELECT 1: boom" {
+		t.Errorf("expected the default error template, got %q", msg)
+	}
+}
+
+func TestLevelTemplates(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:         log,
+			LogSlow:        time.Second,
+			QueryLevel:     logrus.DebugLevel,
+			SlowLevel:      logrus.WarnLevel,
+			ErrorLevel:     logrus.ErrorLevel,
+			LevelTemplates: map[logrus.Level]string{logrus.WarnLevel: "SLOW {{.Level}}: {{.Query}}"},
+		}),
+	)
+
+	tests := []struct {
+		event   *bun.QueryEvent
+		message string
+	}{
+		{logrusbuntest.NewQueryEvent("SELECT 1", nil, 0), "SELECT[*]: SELECT 1"},
+		{logrusbuntest.NewQueryEvent("SELECT 2", nil, 2*time.Second), "SLOW warning: SELECT 2"},
+		{logrusbuntest.NewQueryEvent("SELEC 1", errors.New("syntax error"), 0), "SELEC[*]: SELEC 1: syntax error"},
+	}
+	for _, test := range tests {
+		recorder.Reset()
+		hook.AfterQuery(context.Background(), test.event)
+		entry, ok := recorder.Last()
+		if !ok {
+			t.Errorf("%s: expected an entry", test.event.Query)
+			continue
+		}
+		if message := durationPattern.ReplaceAllString(entry.Message, "[*]"); message != test.message {
+			t.Errorf("%s: expected message %q, got %q", test.event.Query, test.message, message)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for an invalid level template")
+		}
+	}()
+	NewQueryHook(WithQueryHookOptions(QueryHookOptions{
+		Logger:         log,
+		LevelTemplates: map[logrus.Level]string{logrus.WarnLevel: "{{.Query"},
+	}))
+}
+
+func TestErrorLogger(t *testing.T) {
+	var entries, errorEntries []logrus.Entry
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:      newCaptureLogger(&entries),
+			ErrorLogger: newCaptureLogger(&errorEntries),
+			QueryLevel:  logrus.DebugLevel,
+			ErrorLevel:  logrus.ErrorLevel,
+		}),
+	)
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: "SELECT 1", StartTime: time.Now()})
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: "SELECT 2", StartTime: time.Now(), Err: errors.New("boom")})
+	if len(entries) != 1 || len(errorEntries) != 1 || errorEntries[0].Level != logrus.ErrorLevel {
+		t.Fatalf("unexpected routing: %v, %v", entries, errorEntries)
+	}
+}
+
+func TestMaxConcurrentLogs(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithMaxConcurrentLogs(1),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel}),
+	)
+	// hold the only slot as a concurrent logger would
+	hook.logSlots <- struct{}{}
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	<-hook.logSlots
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 2", nil, 0))
+
+	if recorder.Len() != 1 || hook.Summary().Dropped != 1 {
+		t.Fatalf("expected 1 entry and 1 drop, got %d entries, %d drops", recorder.Len(), hook.Summary().Dropped)
+	}
+}
+
+type countingError struct {
+	calls *int
+}
+
+func (e countingError) Error() string {
+	*e.calls++
+	return "counted"
+}
+
+func TestSkipDisabledLevels(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	log.SetLevel(logrus.FatalLevel)
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:        log,
+			LogSlow:       time.Second,
+			QueryLevel:    logrus.DebugLevel,
+			SlowLevel:     logrus.WarnLevel,
+			ErrorLevel:    logrus.ErrorLevel,
+			ErrorTemplate: "{{.Error.Error}}",
+		}),
+	)
+	var calls int
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 2*time.Second))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", countingError{&calls}, 0))
+	if calls != 0 || recorder.Len() != 0 {
+		t.Fatalf("expected nothing to be rendered, got %d renders and %d entries", calls, recorder.Len())
+	}
+}
+
+func TestLargeResult(t *testing.T) {
+	type row struct {
+		ID int64
+	}
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:           log,
+			QueryLevel:       logrus.DebugLevel,
+			LargeResultRows:  3,
+			LargeResultLevel: logrus.WarnLevel,
+			MessageTemplate:  "{{.RowsReturned}}",
+		}),
+	)
+	db := newTestDB()
+	rows := make([]row, 2)
+	event := &bun.QueryEvent{QueryAppender: db.NewSelect().Model(&rows), Query: "SELECT 1", StartTime: time.Now()}
+	hook.AfterQuery(context.Background(), event)
+	if recorder.Len() != 0 {
+		t.Fatalf("expected small results to be skipped, got %d entries", recorder.Len())
+	}
+	rows = append(rows, row{})
+	hook.AfterQuery(context.Background(), event)
+	entry, ok := recorder.Last()
+	if !ok || entry.Level != logrus.WarnLevel || entry.Message != "3" {
+		t.Fatalf("unexpected entry: %v", entry)
+	}
+}
+
+func TestSequence(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithSequence(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel, MessageTemplate: "{{.Seq}}"}),
+	)
+	for i := 0; i < 3; i++ {
+		hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	}
+	for i, entry := range recorder.Entries() {
+		if want := strconv.Itoa(i + 1); entry.Message != want {
+			t.Errorf("expected seq %s, got %s", want, entry.Message)
+		}
+	}
+}
+
+func TestLevelRemap(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithLevelRemap(map[logrus.Level]logrus.Level{logrus.WarnLevel: logrus.InfoLevel}),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:     log,
+			LogSlow:    time.Second,
+			QueryLevel: logrus.DebugLevel,
+			SlowLevel:  logrus.WarnLevel,
+		}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 2*time.Second))
+	entries := recorder.Entries()
+	if len(entries) != 2 || entries[0].Level != logrus.DebugLevel || entries[1].Level != logrus.InfoLevel {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+}
+
+func TestEventOperation(t *testing.T) {
+	db := newTestDB()
+	tests := []struct {
+		event *bun.QueryEvent
+		want  string
+	}{
+		{&bun.QueryEvent{QueryAppender: db.NewSelect(), Query: "SELECT 1"}, "SELECT"},
+		{&bun.QueryEvent{QueryAppender: db.NewCreateIndex(), Query: "CREATE INDEX i ON t (a)"}, "CREATE INDEX"},
+		{&bun.QueryEvent{QueryAppender: db.NewDropIndex(), Query: "DROP INDEX i"}, "DROP INDEX"},
+		{&bun.QueryEvent{Query: "CREATE INDEX i ON t (a)"}, "CREATE"},
+		{&bun.QueryEvent{Query: "PREPARE get_user (int) AS SELECT * FROM users WHERE id = $1"}, "PREPARE"},
+		{&bun.QueryEvent{Query: "EXECUTE get_user(1)"}, "EXECUTE"},
+		{&bun.QueryEvent{Query: "DEALLOCATE get_user"}, "DEALLOCATE"},
+	}
+	for _, test := range tests {
+		if got := eventOperation(test.event); got != test.want {
+			t.Errorf("eventOperation(%q) = %q, want %q", test.event.Query, got, test.want)
+		}
+	}
+}
+
+func TestTraceLevel(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.TraceLevel}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	if entry, ok := recorder.Last(); !ok || entry.Level != logrus.TraceLevel {
+		t.Fatalf("expected a trace entry, got %v", entry)
+	}
+
+	// unknown levels fall back to Log instead of panicking, logrus discards
+	// levels past TraceLevel
+	n := recorder.Len()
+	logAt(log, logrus.Level(42), "unknown")
+	if recorder.Len() != n {
+		t.Errorf("expected an unknown level to be discarded, got %v", recorder.Entries())
+	}
+}
+
+func TestAllLevels(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	var exits int
+	log.ExitFunc = func(int) { exits++ }
+	for _, level := range logrus.AllLevels {
+		func() {
+			defer func() {
+				if r := recover(); r != nil && level != logrus.PanicLevel {
+					t.Errorf("level %v panicked: %v", level, r)
+				}
+			}()
+			if level == logrus.PanicLevel {
+				logAt(log, level, level.String())
+				return
+			}
+			hook := NewQueryHook(
+				WithEnabled(true),
+				WithVerbose(true),
+				WithAllowProcessTermination(true),
+				WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: level, MessageTemplate: "{{.Query}}"}),
+			)
+			hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent(level.String(), nil, 0))
+		}()
+		if entry, ok := recorder.Last(); !ok || entry.Level != level || entry.Message != level.String() {
+			t.Errorf("level %v: unexpected entry %v", level, entry)
+		}
+	}
+	if exits != 1 {
+		t.Errorf("expected FatalLevel to exit once, got %d", exits)
+	}
+}
+
+func TestSkipMigrations(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithSkipMigrations(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel, ErrorLevel: logrus.ErrorLevel}),
+	)
+	db := newTestDB()
+	for _, event := range []*bun.QueryEvent{
+		{QueryAppender: db.NewCreateTable(), Query: `CREATE TABLE "users" ("id" BIGINT)`},
+		{Query: `SELECT "id" FROM "bun_migrations"`},
+		{Query: `INSERT INTO public.bun_migration_locks ("table_name") VALUES ('x')`},
+	} {
+		hook.AfterQuery(context.Background(), event)
+	}
+	if recorder.Len() != 0 {
+		t.Fatalf("expected migration queries to be skipped, got %v", recorder.Entries())
+	}
+
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: `SELECT "id" FROM "users"`})
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: `SELECT "id" FROM "bun_migrations"`, Err: errors.New("boom")})
+	if recorder.Len() != 2 {
+		t.Fatalf("expected regular and failed queries to be logged, got %v", recorder.Entries())
+	}
+}
+
+func TestTenantKey(t *testing.T) {
+	type tenantKey struct{}
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithTenantKey(tenantKey{}, "tenant"),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel}),
+	)
+	hook.AfterQuery(context.WithValue(context.Background(), tenantKey{}, "acme"), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	entries := recorder.Entries()
+	if len(entries) != 2 || entries[0].Data["tenant"] != "acme" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	if _, ok := entries[1].Data["tenant"]; ok {
+		t.Errorf("expected the field to be omitted, got %v", entries[1].Data)
+	}
+}
+
+type testCtxKey string
+
+func (k testCtxKey) String() string { return "ctx." + string(k) }
+
+func TestContextValues(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithContextValues(testCtxKey("request_id"), testCtxKey("user"), testCtxKey("count")),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel}),
+	)
+	ctx := context.WithValue(context.Background(), testCtxKey("request_id"), "r1")
+	ctx = context.WithValue(ctx, testCtxKey("user"), testCtxKey("bob"))
+	ctx = context.WithValue(ctx, testCtxKey("count"), 3)
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	entry, _ := recorder.Last()
+	if entry.Data["ctx.request_id"] != "r1" || entry.Data["ctx.user"] != "ctx.bob" {
+		t.Errorf("expected the string and stringer values, got %v", entry.Data)
+	}
+	if _, ok := entry.Data["ctx.count"]; ok {
+		t.Errorf("expected the int value to be skipped, got %v", entry.Data)
+	}
+}
+
+func TestFromEnvLevels(t *testing.T) {
+	for key, value := range map[string]string{
+		"LOGRUSBUN_TEST_QUERY_LEVEL": "trace",
+		"LOGRUSBUN_TEST_ERROR_LEVEL": "loud",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		FromEnvLevels("LOGRUSBUN_TEST"),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:     log,
+			QueryLevel: logrus.DebugLevel,
+			SlowLevel:  logrus.WarnLevel,
+			ErrorLevel: logrus.ErrorLevel,
+		}),
+	)
+	if hook.opts.QueryLevel != logrus.TraceLevel || hook.opts.SlowLevel != logrus.WarnLevel || hook.opts.ErrorLevel != logrus.ErrorLevel {
+		t.Errorf("unexpected levels: %v, %v, %v", hook.opts.QueryLevel, hook.opts.SlowLevel, hook.opts.ErrorLevel)
+	}
+	if entry, ok := recorder.Last(); !ok || entry.Level != logrus.WarnLevel {
+		t.Errorf("expected a warning for the invalid level, got %v", entry)
+	}
+}
+
+func TestEntryDecorator(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	var retained []*LogEntryVars
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithEntryDecorator(func(entry *logrus.Entry, vars *LogEntryVars) *logrus.Entry {
+			retained = append(retained, vars)
+			if vars.Operation == "DELETE" {
+				return nil
+			}
+			entry = entry.WithField("op", vars.Operation)
+			entry.Message = "decorated: " + vars.Query
+			return entry
+		}),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("DELETE FROM users", nil, 0))
+	entries := recorder.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %v", entries)
+	}
+	if entries[0].Message != "decorated: SELECT 1" || entries[0].Data["op"] != "SELECT" {
+		t.Errorf("unexpected entry: %v", entries[0])
+	}
+
+	// the decorator owns the vars it gets
+	if len(retained) != 2 || retained[0].Query != "SELECT 1" || retained[1].Query != "DELETE FROM users" {
+		t.Errorf("expected the retained vars to be left intact, got %+v", retained)
+	}
+}
+
+func TestWaitDuration(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:          log,
+			QueryLevel:      logrus.DebugLevel,
+			MessageTemplate: "{{.WaitDuration}} {{eq .ExecDuration .Duration}}",
+		}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, time.Millisecond))
+	if entry, ok := recorder.Last(); !ok || entry.Message != "0s true" {
+		t.Errorf("unexpected entry: %v", entry)
+	}
+}
+
+func TestName(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithName("audit"),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:          log,
+			QueryLevel:      logrus.DebugLevel,
+			MessageTemplate: "{{.HookName}}: {{.Query}}",
+		}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	if entry, ok := recorder.Last(); !ok || entry.Message != "audit: SELECT 1" || entry.Data["hook"] != "audit" {
+		t.Errorf("unexpected entry: %v", entry)
+	}
+}
+
+func TestRenderVars(t *testing.T) {
+	log, _ := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithDialectTemplate("sqlite", "sqlite {{.Query}}", ""),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:          log,
+			MessageTemplate: "{{.Operation}}: {{.Query}}",
+			ErrorTemplate:   "{{.Query}} failed: {{.Error}}",
+		}),
+	)
+	for _, test := range []struct {
+		vars    LogEntryVars
+		isError bool
+		want    string
+	}{
+		{LogEntryVars{Operation: "SELECT", Query: "SELECT 1"}, false, "SELECT: SELECT 1"},
+		{LogEntryVars{Query: "SELECT 1", Error: errors.New("boom")}, true, "SELECT 1 failed: boom"},
+		{LogEntryVars{Query: "SELECT 1", Dialect: "sqlite"}, false, "sqlite SELECT 1"},
+	} {
+		msg, err := hook.RenderVars(test.vars, test.isError)
+		if err != nil || msg != test.want {
+			t.Errorf("expected %q, got %q (%v)", test.want, msg, err)
+		}
+	}
+
+	hook = NewQueryHook(WithQueryHookOptions(QueryHookOptions{Logger: log, MessageTemplate: "{{.Event.Query}}"}))
+	if _, err := hook.RenderVars(LogEntryVars{}, false); err == nil {
+		t.Error("expected a template error")
+	}
+}
+
+func TestDeadlinePressureWarn(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithDeadlinePressureWarn(0.9, logrus.WarnLevel),
+		WithQueryHookOptions(QueryHookOptions{Logger: log}),
+	)
+	start := time.Now().Add(-95 * time.Millisecond)
+	ctx, cancel := context.WithDeadline(context.Background(), start.Add(100*time.Millisecond))
+	defer cancel()
+	hook.AfterQuery(ctx, &bun.QueryEvent{Query: "SELECT 1", StartTime: start})
+	entry, ok := recorder.Last()
+	if !ok || entry.Level != logrus.WarnLevel {
+		t.Fatalf("expected a warning, got %v", entry)
+	}
+	if pressure, _ := entry.Data["deadline_pressure"].(float64); pressure < 0.9 {
+		t.Errorf("unexpected deadline pressure: %v", entry.Data)
+	}
+
+	recorder.Reset()
+	ctx, cancel = context.WithDeadline(context.Background(), start.Add(time.Hour))
+	defer cancel()
+	hook.AfterQuery(ctx, &bun.QueryEvent{Query: "SELECT 1", StartTime: start})
+	hook.AfterQuery(context.Background(), &bun.QueryEvent{Query: "SELECT 1", StartTime: start})
+	if recorder.Len() != 0 {
+		t.Errorf("expected no entries, got %v", recorder.Entries())
+	}
+}
+
+func TestQueryAllowlist(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryAllowlist(regexp.MustCompile(`\borders\b`)),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel, ErrorLevel: logrus.ErrorLevel}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT * FROM orders", nil, 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT * FROM users", nil, 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT * FROM orders_archive", errors.New("boom"), 0))
+	if recorder.Len() != 1 {
+		t.Errorf("expected 1 entry, got %v", recorder.Entries())
+	}
+}
+
+func TestWarnMissingWhere(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithWarnMissingWhere(logrus.WarnLevel),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, ErrorLevel: logrus.ErrorLevel}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent(`DELETE FROM "users"`, nil, 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent(`DELETE FROM "users" WHERE "id" = 1`, nil, 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent(`UPDATE "users" SET "n" = 1`, errors.New("boom"), 0))
+	entries := recorder.Entries()
+	if len(entries) != 2 || entries[0].Level != logrus.WarnLevel || entries[0].Data["missing_where"] != true {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	if entries[1].Level != logrus.ErrorLevel || entries[1].Data["missing_where"] != true {
+		t.Errorf("expected the error level to be kept, got %v", entries[1])
+	}
+}
+
+func TestEventChannel(t *testing.T) {
+	log, _ := logrusbuntest.NewLogger()
+	events := make(chan LogEntryVars, 1)
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithEventChannel(events),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	// the channel is full, the event is dropped without blocking
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 2", nil, 0))
+	close(events)
+	var queries []string
+	for vars := range events {
+		queries = append(queries, vars.Query)
+	}
+	if len(queries) != 1 || queries[0] != "SELECT 1" {
+		t.Errorf("unexpected events: %v", queries)
+	}
+}
+
+func TestSlowStack(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithSlowStack(2),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, LogSlow: time.Millisecond, SlowLevel: logrus.WarnLevel, QueryLevel: logrus.DebugLevel}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, time.Second))
+	entries := recorder.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v", entries)
+	}
+	if _, ok := entries[0].Data["stack"]; ok {
+		t.Errorf("expected no stack for a fast query, got %v", entries[0].Data)
+	}
+	stack, _ := entries[1].Data["stack"].(string)
+	lines := strings.Split(stack, "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "github.com/oiime/logrusbun.TestSlowStack ") {
+		t.Errorf("unexpected stack: %q", stack)
+	}
+}
+
+func TestModuleAttribution(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithModuleAttribution("github.com/oiime/"),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel, MessageTemplate: "{{.Module}}"}),
+	)
+	for i := 0; i < 2; i++ {
+		hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+		entry, _ := recorder.Last()
+		if entry.Message != "logrusbun" || entry.Data["module"] != "logrusbun" {
+			t.Errorf("unexpected module: %q, %v", entry.Message, entry.Data)
+		}
+	}
+
+	for function, want := range map[string]string{
+		"github.com/acme/app/repo/users.(*Repo).Get": "github.com/acme/app/repo/users",
+		"github.com/acme/app/repo/users.Get.func1":   "github.com/acme/app/repo/users",
+		"main.main": "main",
+	} {
+		if got := funcPackage(function); got != want {
+			t.Errorf("funcPackage(%q) = %q, want %q", function, got, want)
+		}
+	}
+}
+
+func TestTraceSampling(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithTraceSampling(0.5),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel}),
+	)
+	sampledTraces := 0
+	for i := 0; i < 200; i++ {
+		ctx := WithTraceID(context.Background(), strconv.Itoa(i))
+		recorder.Reset()
+		for j := 0; j < 3; j++ {
+			hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+		}
+		switch recorder.Len() {
+		case 3:
+			sampledTraces++
+		case 0:
+		default:
+			t.Fatalf("trace %d: expected all or none of the queries, got %d", i, recorder.Len())
+		}
+	}
+	if sampledTraces < 50 || sampledTraces > 150 {
+		t.Errorf("expected about half of the traces to be sampled, got %d", sampledTraces)
+	}
+
+	if !sampleTrace("", 1, func() float64 { return 1 }) {
+		t.Error("expected queries without a trace ID to be sampled at rate 1")
+	}
+}
+
+func BenchmarkAfterQuery(b *testing.B) {
+	log, _ := logrusbuntest.NewLogger()
+	log.Hooks = make(logrus.LevelHooks)
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel}),
+	)
+	ctx := context.Background()
+	event := logrusbuntest.NewQueryEvent(`SELECT "u"."id" FROM "users" AS "u" WHERE "u"."id" = 1`, nil, time.Millisecond)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			hook.AfterQuery(ctx, event)
+		}
+	})
+}
+
+func TestConstantTemplate(t *testing.T) {
+	if tmpl := parseTemplate("test", "query {{/* comment */}}ran", [2]string{}); !tmpl.isConstant || tmpl.constant != "query ran" {
+		t.Errorf("expected a constant template, got %+v", tmpl)
+	}
+	if tmpl := parseTemplate("test", "query ran in {{.Duration}}", [2]string{}); tmpl.isConstant {
+		t.Error("expected a dynamic template")
+	}
+
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel, MessageTemplate: "query ran"}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	if entry, _ := recorder.Last(); entry.Message != "query ran" {
+		t.Errorf("unexpected message: %q", entry.Message)
+	}
+}
+
+func TestTemplateFields(t *testing.T) {
+	tests := []struct {
+		text      string
+		uses      []string
+		allFields bool
+	}{
+		{"{{.Operation}}: {{.Query}}", []string{"Operation", "Query"}, false},
+		{"{{range .Tables}}{{.}} {{end}}", []string{"Tables"}, false},
+		{"{{with .Event}}{{.Query}}{{end}}", []string{"Event"}, false},
+		{"{{range .Tables}}{{$.Schema}}{{else}}{{.Table}}{{end}}", []string{"Tables", "Schema", "Table"}, false},
+		{"{{if .Error}}{{.Error}}{{end}}", []string{"Error"}, false},
+		{`{{printf "%v" .}}`, nil, true},
+	}
+	for _, test := range tests {
+		tmpl := parseTemplate("test", test.text, [2]string{})
+		var uses []string
+		for field := range tmpl.fields {
+			uses = append(uses, field)
+		}
+		sort.Strings(uses)
+		sort.Strings(test.uses)
+		if !reflect.DeepEqual(uses, test.uses) || tmpl.allFields != test.allFields {
+			t.Errorf("%q: expected %v (all: %v), got %v (all: %v)", test.text, test.uses, test.allFields, uses, tmpl.allFields)
+		}
+	}
+
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(WithQueryHookOptions(QueryHookOptions{Logger: log}))
+	if hook.tablesUsed || hook.columnsUsed {
+		t.Error("expected the default templates not to need the tables and columns")
+	}
+	hook = NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel, MessageTemplate: "{{.Tables}}"}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT * FROM t", nil, 0))
+	if entry, _ := recorder.Last(); entry.Message != "[t]" {
+		t.Errorf("expected the tables to be parsed when used, got %q", entry.Message)
+	}
+}
+
+func BenchmarkConstantTemplate(b *testing.B) {
+	log, _ := logrusbuntest.NewLogger()
+	hook := NewQueryHook(WithQueryHookOptions(QueryHookOptions{Logger: log, MessageTemplate: "query ran"}))
+	vars := &LogEntryVars{Query: "SELECT 1", Operation: "SELECT"}
+	b.Run("execute", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var msg bytes.Buffer
+			if err := hook.messageTemplate.Execute(&msg, vars); err != nil {
+				b.Fatal(err)
+			}
+			_ = msg.String()
+		}
+	})
+	b.Run("constant", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := hook.renderVars(vars, false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestString(t *testing.T) {
+	log, _ := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:     log,
+			LogSlow:    100 * time.Millisecond,
+			QueryLevel: logrus.DebugLevel,
+			SlowLevel:  logrus.WarnLevel,
+		}),
+	)
+	want := "logrusbun.QueryHook{enabled: true, verbose: false, query: debug, slow: warning >100ms, error: off, templates: default}"
+	if got := hook.String(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if got := fmt.Sprintf("%#v", hook); !strings.Contains(got, `"{{.Operation}}[{{.Duration}}]: {{.Query}}"`) {
+		t.Errorf("expected the templates source, got %q", got)
+	}
+}
+
+func TestStartupSelfTest(t *testing.T) {
+	log, _ := logrusbuntest.NewLogger()
+	NewQueryHook(
+		WithStartupSelfTest(true),
+		WithDialectTemplate("sqlite", "{{.Event.Query}}", ""),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, ErrorTemplate: "{{.Error.Error}}"}),
+	)
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a failing error template")
+		}
+	}()
+	NewQueryHook(
+		WithStartupSelfTest(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, ErrorTemplate: "{{.Error.Code}}"}),
+	)
+}
+
+func TestLevelLoggers(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	slowLog, slowRecorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:       log,
+			LevelLoggers: map[logrus.Level]logrus.FieldLogger{logrus.WarnLevel: slowLog, logrus.ErrorLevel: nil},
+			LogSlow:      time.Millisecond,
+			QueryLevel:   logrus.DebugLevel,
+			SlowLevel:    logrus.WarnLevel,
+			ErrorLevel:   logrus.ErrorLevel,
+		}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 2", nil, time.Second))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 3", errors.New("boom"), 0))
+	if recorder.Len() != 2 || slowRecorder.Len() != 1 {
+		t.Fatalf("unexpected routing: %v, %v", recorder.Entries(), slowRecorder.Entries())
+	}
+	if entry, _ := slowRecorder.Last(); entry.Level != logrus.WarnLevel {
+		t.Errorf("expected the slow query, got %v", entry)
+	}
+}
+
+func TestDefaultMasking(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithDefaultMasking(MaskPatternEmail),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel, MessageTemplate: "{{.Query}}"}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent(`SELECT * FROM "users" WHERE "email" = 'a@b.io' AND "password" = 'x'`, nil, 0))
+	if entry, _ := recorder.Last(); entry.Message != `SELECT * FROM "users" WHERE "email" = '***' AND "password" = ***` {
+		t.Errorf("unexpected message: %s", entry.Message)
+	}
+}
+
+func TestArgsString(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithArgsString(2),
+		WithDefaultMasking(MaskPatternEmail),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel, MessageTemplate: "{{.ArgsString}}"}),
+	)
+	event := logrusbuntest.NewQueryEvent(`SELECT * FROM "users" WHERE "email" = ? AND "id" = ? AND "age" > ?`, nil, 0)
+	event.QueryArgs = []interface{}{"a@b.io", 1, 18}
+	hook.AfterQuery(context.Background(), event)
+	if entry, _ := recorder.Last(); entry.Message != `["***":string, 1:int, ... 1 more]` {
+		t.Errorf("unexpected message: %s", entry.Message)
+	}
+}
+
+func TestAbbreviatedOperation(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithAbbreviatedOperation(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel, MessageTemplate: "{{.Operation}}"}),
+	)
+	for _, query := range []string{"SELECT 1", "delete from users", "VACUUM"} {
+		hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent(query, nil, 0))
+	}
+	var got []string
+	for _, entry := range recorder.Entries() {
+		got = append(got, entry.Message)
+	}
+	if strings.Join(got, ",") != "S,D,VACUUM" {
+		t.Errorf("unexpected operations: %v", got)
+	}
+}
+
+func TestSuppressHealthChecks(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithSuppressHealthChecks(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel, ErrorLevel: logrus.ErrorLevel}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("select  1;", nil, 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT version()", nil, 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", errors.New("boom"), 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 10", nil, 0))
+	if recorder.Len() != 2 {
+		t.Errorf("expected the failed and non health check queries, got %v", recorder.Entries())
+	}
+
+	recorder.Reset()
+	hook = NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithSuppressHealthChecks(true),
+		WithHealthCheckQueries("SELECT now()"),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT NOW()", nil, 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	if recorder.Len() != 1 {
+		t.Errorf("expected the overridden queries only to be skipped, got %v", recorder.Entries())
+	}
+}
+
+func TestStructuredFieldNames(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithStructuredFields(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:         log,
+			ErrorLevel:     logrus.ErrorLevel,
+			QueryFieldName: "sql",
+			ErrorFieldName: "err",
+		}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", errors.New("boom"), 0))
+	entry, _ := recorder.Last()
+	if entry.Data["sql"] != "SELECT 1" || entry.Data["err"] != "boom" || entry.Data["operation"] != "SELECT" {
+		t.Errorf("unexpected fields: %v", entry.Data)
+	}
+	if _, ok := entry.Data["query"]; ok {
+		t.Errorf("expected the default query field to be renamed, got %v", entry.Data)
+	}
+}
+
+func TestNoHTMLEscape(t *testing.T) {
+	const query = `SELECT * FROM "t" WHERE a < 1 AND b > 2 AND c & 4 = 0 AND d = 'it''s' AND e <> "f"`
+	for _, structured := range []bool{false, true} {
+		log, recorder := logrusbuntest.NewLogger()
+		hook := NewQueryHook(
+			WithEnabled(true),
+			WithVerbose(true),
+			WithStructuredFields(structured),
+			WithQueryHookOptions(QueryHookOptions{
+				Logger:          log,
+				QueryLevel:      logrus.DebugLevel,
+				ErrorLevel:      logrus.ErrorLevel,
+				MessageTemplate: "{{.Query}}",
+				ErrorTemplate:   "{{.Query}}: {{.Error}}",
+			}),
+		)
+		hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent(query, nil, 0))
+		hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent(query, errors.New(`<"&">`), 0))
+		entries := recorder.Entries()
+		if len(entries) != 2 {
+			t.Fatalf("expected 2 entries, got %v", entries)
+		}
+		if structured {
+			if entries[0].Data["query"] != query || entries[1].Data["error"] != `<"&">` {
+				t.Errorf("expected verbatim fields, got %v", entries[1].Data)
+			}
+			continue
+		}
+		if entries[0].Message != query || entries[1].Message != query+`: <"&">` {
+			t.Errorf("expected verbatim messages, got %q, %q", entries[0].Message, entries[1].Message)
+		}
+	}
+
+	msg, err := NewQueryHook(WithQueryHookOptions(QueryHookOptions{})).RenderVars(LogEntryVars{Operation: "SELECT", Query: query}, false)
+	if err != nil || !strings.HasSuffix(msg, ": "+query) {
+		t.Errorf("expected a verbatim rendering, got %q (%v)", msg, err)
+	}
+}
+
+func TestSlowFullQuery(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithSanitizeInClauses(2),
+		WithSlowFullQuery(true),
+		WithMaskPatterns("***", regexp.MustCompile(`token = ('\w+')`)),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:          log,
+			LogSlow:         time.Second,
+			QueryLevel:      logrus.DebugLevel,
+			SlowLevel:       logrus.WarnLevel,
+			MessageTemplate: "{{.Query}}",
+		}),
+	)
+	const query = `SELECT * FROM t WHERE id IN (1, 2, 3) AND token = 'abc'`
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent(query, nil, 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent(query, nil, 2*time.Second))
+	entries := recorder.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v", entries)
+	}
+	if !strings.Contains(entries[0].Message, "3 values") || !strings.Contains(entries[0].Message, "token = ***") {
+		t.Errorf("expected a collapsed and masked query, got %q", entries[0].Message)
+	}
+	if entries[1].Message != `SELECT * FROM t WHERE id IN (1, 2, 3) AND token = ***` {
+		t.Errorf("expected the full masked query, got %q", entries[1].Message)
+	}
+}
+
+func TestTimestampUnix(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithStructuredFields(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel}),
+	)
+	before := time.Now()
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	entry, _ := recorder.Last()
+	millis, _ := entry.Data["ts_unix_ms"].(int64)
+	if seconds, _ := entry.Data["ts_unix"].(int64); seconds != millis/1000 || seconds < before.Unix() {
+		t.Errorf("unexpected timestamps: %v", entry.Data)
+	}
+}
+
+func TestCanceledLevel(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	driverErr := errors.New("driver: bad connection")
+	for _, test := range []struct {
+		grace bool
+		ctx   context.Context
+		err   error
+		want  logrus.Level
+	}{
+		{false, context.Background(), fmt.Errorf("query: %w", context.Canceled), logrus.InfoLevel},
+		{false, canceled, driverErr, logrus.ErrorLevel},
+		{true, canceled, driverErr, logrus.InfoLevel},
+		{true, context.Background(), driverErr, logrus.ErrorLevel},
+	} {
+		log, recorder := logrusbuntest.NewLogger()
+		hook := NewQueryHook(
+			WithEnabled(true),
+			WithContextCancellationGrace(test.grace),
+			WithQueryHookOptions(QueryHookOptions{Logger: log, ErrorLevel: logrus.ErrorLevel, CanceledLevel: logrus.InfoLevel}),
+		)
+		hook.AfterQuery(test.ctx, logrusbuntest.NewQueryEvent("SELECT 1", test.err, 0))
+		if entry, ok := recorder.Last(); !ok || entry.Level != test.want {
+			t.Errorf("grace %v, %v: expected %v, got %v", test.grace, test.err, test.want, entry.Level)
+		}
+	}
+}
+
+func TestIgnoreContextCanceledDuration(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithIgnoreContextCanceledDuration(time.Second),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, ErrorLevel: logrus.ErrorLevel}),
+	)
+	ctx := context.Background()
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", context.Canceled, 2*time.Second))
+	if recorder.Len() != 0 {
+		t.Fatalf("expected a late cancellation to be skipped, got %d entries", recorder.Len())
+	}
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 2", context.Canceled, time.Millisecond))
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 3", errors.New("boom"), 2*time.Second))
+	if recorder.Len() != 2 {
+		t.Fatalf("expected quick cancellations and other errors to be logged, got %d entries", recorder.Len())
+	}
+}
+
+func TestDisabledAllocs(t *testing.T) {
+	log, _ := logrusbuntest.NewLogger()
+	hook := NewQueryHook(WithQueryHookOptions(QueryHookOptions{Logger: log, ErrorLevel: logrus.ErrorLevel}))
+	ctx := context.Background()
+	event := logrusbuntest.NewQueryEvent("SELECT 1", errors.New("boom"), time.Millisecond)
+	allocs := testing.AllocsPerRun(100, func() {
+		hook.AfterQuery(hook.BeforeQuery(ctx, event), event)
+	})
+	if allocs != 0 {
+		t.Errorf("expected a disabled hook not to allocate, got %v allocs", allocs)
+	}
+}
+
+func BenchmarkDisabled(b *testing.B) {
+	log, _ := logrusbuntest.NewLogger()
+	hook := NewQueryHook(WithQueryHookOptions(QueryHookOptions{Logger: log, ErrorLevel: logrus.ErrorLevel}))
+	ctx := context.Background()
+	event := logrusbuntest.NewQueryEvent("SELECT 1", errors.New("boom"), time.Millisecond)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		hook.AfterQuery(hook.BeforeQuery(ctx, event), event)
+	}
+}
+
+func TestLogPanic(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, ErrorTemplate: "{{.Query}}: {{.Error}}"}),
+	)
+	ctx := WithLastQuery(context.Background())
+	event := logrusbuntest.NewQueryEvent("SELECT * FROM users", nil, 0)
+	hook.BeforeQuery(ctx, event)
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				hook.LogPanic(ctx, r)
+			}
+		}()
+		panic("scan failed")
+	}()
+	entry, ok := recorder.Last()
+	if !ok || entry.Level != logrus.ErrorLevel || entry.Message != "SELECT * FROM users: panic: scan failed" || entry.Data["panic"] != "scan failed" {
+		t.Errorf("unexpected entry: %v", entry)
+	}
+
+	hook.LogPanic(context.Background(), "boom")
+	if entry, _ := recorder.Last(); entry.Message != ": panic: boom" {
+		t.Errorf("expected a panic without a query, got %q", entry.Message)
+	}
+
+	recorder.Reset()
+	hook = NewQueryHook(
+		WithEnabled(true),
+		WithDefaultMasking(),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, ErrorTemplate: "{{.Query}}: {{.Error}}"}),
+	)
+	hook.BeforeQuery(ctx, logrusbuntest.NewQueryEvent("SELECT * FROM users WHERE password = 'hunter2'", nil, 0))
+	hook.LogPanic(ctx, "scan failed")
+	if entry, _ := recorder.Last(); entry.Message != "SELECT * FROM users WHERE password = ***: panic: scan failed" {
+		t.Errorf("expected the query to be masked, got %q", entry.Message)
+	}
+
+	recorder.Reset()
+	WithEnabled(false)(hook)
+	hook.LogPanic(ctx, "scan failed")
+	if recorder.Len() != 0 {
+		t.Errorf("expected a disabled hook not to log, got %v", recorder.Entries())
+	}
+	// levels are capped, remapped and skipped when disabled like queries
+	recorder.Reset()
+	hook = NewQueryHook(
+		WithEnabled(true),
+		WithMaxLevel(logrus.InfoLevel),
+		WithLevelRemap(map[logrus.Level]logrus.Level{logrus.InfoLevel: logrus.DebugLevel}),
+		WithQueryHookOptions(QueryHookOptions{Logger: log}),
+	)
+	hook.LogPanic(ctx, "scan failed")
+	if entry, ok := recorder.Last(); !ok || entry.Level != logrus.DebugLevel {
+		t.Errorf("expected the panic capped to info and remapped to debug, got %v", recorder.Entries())
+	}
+	recorder.Reset()
+	log.SetLevel(logrus.InfoLevel)
+	defer log.SetLevel(logrus.TraceLevel)
+	hook.LogPanic(ctx, "scan failed")
+	if recorder.Len() != 0 {
+		t.Errorf("expected a disabled level not to be logged, got %v", recorder.Entries())
+	}
+}
+
+func TestMaxFieldLength(t *testing.T) {
+	if got := truncateField("héllo", 2); got != "h..." {
+		t.Errorf("expected a rune safe cut, got %q", got)
+	}
+	if got := truncateField("hello", 5); got != "hello" {
+		t.Errorf("expected short values to be kept, got %q", got)
+	}
+
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithStructuredFields(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, ErrorLevel: logrus.ErrorLevel, MaxFieldLength: 8}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT * FROM users", errors.New("relation does not exist"), 0))
+	entry, _ := recorder.Last()
+	if entry.Data["query"] != "SELECT *..." || entry.Data["error"] != "relation..." || entry.Data["operation"] != "SELECT" {
+		t.Errorf("unexpected fields: %v", entry.Data)
+	}
+}
+
+func TestAllowProcessTermination(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		log, recorder := logrusbuntest.NewLogger()
+		var exits int
+		log.ExitFunc = func(int) { exits++ }
+		hook := NewQueryHook(
+			WithEnabled(true),
+			WithAllowProcessTermination(allow),
+			WithQueryHookOptions(QueryHookOptions{Logger: log, ErrorLevel: logrus.FatalLevel}),
+		)
+		hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("DROP DATABASE prod", errors.New("boom"), 0))
+		entry, ok := recorder.Last()
+		if !ok {
+			t.Fatalf("allow %v: expected an entry", allow)
+		}
+		if allow {
+			if entry.Level != logrus.FatalLevel || exits != 1 {
+				t.Errorf("expected a fatal entry and an exit, got %v and %d exits", entry.Level, exits)
+			}
+			continue
+		}
+		if entry.Level != logrus.ErrorLevel || entry.Data["intended_level"] != "fatal" || exits != 0 {
+			t.Errorf("expected an error entry without exiting, got %v, %v and %d exits", entry.Level, entry.Data, exits)
+		}
+	}
+}
+
+func TestSampleRates(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:      log,
+			LogSlow:     time.Second,
+			QueryLevel:  logrus.DebugLevel,
+			SlowLevel:   logrus.WarnLevel,
+			ErrorLevel:  logrus.ErrorLevel,
+			SampleRate:  0.5,
+			SampleRates: map[string]float64{"select": 0, "INSERT": 1},
+		}),
+	)
+	ctx := context.Background()
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	if recorder.Len() != 0 {
+		t.Fatalf("expected SELECTs to be skipped, got %v", recorder.Entries())
+	}
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", errors.New("boom"), 0))
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", nil, 2*time.Second))
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("INSERT INTO t VALUES (1)", nil, 0))
+	if recorder.Len() != 3 {
+		t.Fatalf("expected failed, slow and sampled queries, got %v", recorder.Entries())
+	}
+
+	recorder.Reset()
+	for i := 0; i < 1000; i++ {
+		hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("UPDATE t SET a = 1 WHERE id = 1", nil, 0))
+	}
+	if n := recorder.Len(); n < 400 || n > 600 {
+		t.Errorf("expected about half of the UPDATEs to be logged, got %d", n)
+	}
+}
+
+func TestQueryTransforms(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	var seen []string
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		// registered before the built-ins, still runs after them
+		WithQueryTransforms(
+			func(query string) string {
+				seen = append(seen, query)
+				return strings.TrimSuffix(query, " -- trace")
+			},
+			func(query string) string { return query[:24] },
+		),
+		WithSanitizeInClauses(1),
+		WithMaskPatterns("***", regexp.MustCompile(`token = ('\w+')`)),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel, MessageTemplate: "{{.Query}}"}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1 WHERE token = 'abc' AND id IN (1, 2) -- trace", nil, 0))
+	if len(seen) != 1 || strings.Contains(seen[0], "abc") || strings.Contains(seen[0], "1, 2") {
+		t.Errorf("expected transforms to get a redacted and normalized query, got %v", seen)
+	}
+	if entry, _ := recorder.Last(); entry.Message != "SELECT 1 WHERE token = *" {
+		t.Errorf("unexpected message: %q", entry.Message)
+	}
+}
+
+func TestSuccess(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:          log,
+			QueryLevel:      logrus.DebugLevel,
+			ErrorLevel:      logrus.ErrorLevel,
+			MessageTemplate: "{{.Success}}",
+			ErrorTemplate:   "{{.Success}}",
+		}),
+	)
+	ctx := context.Background()
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", sql.ErrNoRows, 0))
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", errors.New("boom"), 0))
+	var got []string
+	for _, entry := range recorder.Entries() {
+		got = append(got, entry.Message)
+	}
+	if strings.Join(got, ",") != "true,true,false" {
+		t.Errorf("unexpected messages: %v", got)
+	}
+
+	// rendered with the error template, still a success
+	recorder.Reset()
+	hook = NewQueryHook(
+		WithEnabled(true),
+		WithQueryHookOptions(QueryHookOptions{
+			Logger:        log,
+			NoRowsLevel:   logrus.InfoLevel,
+			ErrorTemplate: "{{.Success}}",
+		}),
+	)
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", sql.ErrNoRows, 0))
+	if entry, ok := recorder.Last(); !ok || entry.Level != logrus.InfoLevel || entry.Message != "true" {
+		t.Errorf("expected no rows to render as a success, got %v", recorder.Entries())
+	}
+}
+
+func TestOperationAliases(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithAbbreviatedOperation(true),
+		WithOperationAliases(map[string]string{"select": "read", "Insert": "create"}),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel, MessageTemplate: "{{.Operation}}"}),
+	)
+	for _, query := range []string{"select 1", "INSERT INTO t VALUES (1)", "DELETE FROM t", "VACUUM"} {
+		hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent(query, nil, 0))
+	}
+	var got []string
+	for _, entry := range recorder.Entries() {
+		got = append(got, entry.Message)
+	}
+	if strings.Join(got, ",") != "read,create,D,VACUUM" {
+		t.Errorf("unexpected operations: %v", got)
+	}
+}
+
+func TestCacheStatus(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithStructuredFields(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel}),
+	)
+	hook.AfterQuery(WithCacheStatus(context.Background(), "miss"), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	entries := recorder.Entries()
+	if len(entries) != 2 || entries[0].Data["cache_status"] != "miss" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	if _, ok := entries[1].Data["cache_status"]; ok {
+		t.Errorf("expected no cache status, got %v", entries[1].Data)
+	}
+}
+
+func TestErrorFieldName(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithStructuredFields(true),
+		WithErrorFieldName("err"),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, ErrorLevel: logrus.ErrorLevel, ErrorTemplate: "{{.Query}}: {{.Error}}"}),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", errors.New("boom"), 0))
+	entry, _ := recorder.Last()
+	if entry.Data["err"] != "boom" {
+		t.Errorf("expected the error as a field, got %v", entry.Data)
+	}
+	if _, ok := entry.Data["error"]; ok || strings.Contains(entry.Message, "boom") {
+		t.Errorf("expected the error in its field only, got %q and %v", entry.Message, entry.Data)
+	}
+	// applied over QueryHookOptions whatever the order
+	hook = NewQueryHook(
+		WithEnabled(true),
+		WithStructuredFields(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, ErrorLevel: logrus.ErrorLevel}),
+		WithErrorFieldName("err"),
+	)
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", errors.New("boom"), 0))
+	if entry, _ := recorder.Last(); entry.Data["err"] != "boom" {
+		t.Errorf("expected the error as a field, got %v", entry.Data)
+	}
+}
+
+func TestQueryBytes(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithStructuredFields(true),
+		WithSanitizeInClauses(1),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel}),
+	)
+	const query = "SELECT * FROM t WHERE id IN (1, 2, 3)"
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent(query, nil, 0))
+	if entry, _ := recorder.Last(); entry.Data["query_bytes"] != len(query) {
+		t.Errorf("expected the raw query length, got %v", entry.Data)
+	}
+}
+
+func TestIsolationMismatch(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, MessageTemplate: "{{.IsolationMismatch}}"}),
+	)
+	ctx := WithExpectedIsolation(context.Background(), sql.LevelSerializable)
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	hook.AfterQuery(WithTxIsolation(ctx, sql.LevelSerializable), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	if recorder.Len() != 0 {
+		t.Fatalf("expected no entries, got %v", recorder.Entries())
+	}
+	hook.AfterQuery(WithTxIsolation(ctx, sql.LevelReadCommitted), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	entry, ok := recorder.Last()
+	if !ok || entry.Level != logrus.WarnLevel || entry.Message != "expected Serializable, got Read Committed" || entry.Data["isolation_mismatch"] != entry.Message {
+		t.Errorf("unexpected entry: %v", entry)
+	}
+}
+
+func TestDurationTiers(t *testing.T) {
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithDurationTiers([]DurationTier{
+			{Threshold: 0, Name: "normal"},
+			{Threshold: time.Second, Name: "slow", Level: logrus.WarnLevel},
+		}),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel, ErrorLevel: logrus.ErrorLevel}),
+	)
+	ctx := context.Background()
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", nil, 2*time.Second))
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", errors.New("boom"), 2*time.Second))
+	entries := recorder.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %v", entries)
+	}
+	for i, want := range []struct {
+		level logrus.Level
+		tier  string
+	}{{logrus.DebugLevel, "normal"}, {logrus.WarnLevel, "slow"}, {logrus.ErrorLevel, "slow"}} {
+		if entries[i].Level != want.level || entries[i].Data["tier"] != want.tier {
+			t.Errorf("entry %d: expected %v/%s, got %v/%v", i, want.level, want.tier, entries[i].Level, entries[i].Data)
+		}
+	}
+
+	// escalated tiers bypass sampling
+	log, recorder = logrusbuntest.NewLogger()
+	hook = NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithRand(rand.New(rand.NewSource(1))),
+		WithDurationTiers([]DurationTier{
+			{Threshold: 0, Name: "normal"},
+			{Threshold: time.Second, Name: "slow", Level: logrus.WarnLevel},
+		}),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel, SampleRate: 0.000001}),
+	)
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", nil, 2*time.Second))
+	if entries := recorder.Entries(); len(entries) != 1 || entries[0].Data["tier"] != "slow" {
+		t.Errorf("expected only the escalated query to be logged, got %v", entries)
+	}
+}
+
+func TestBaggageKeys(t *testing.T) {
+	type baggageKey struct{}
+	log, recorder := logrusbuntest.NewLogger()
+	hook := NewQueryHook(
+		WithEnabled(true),
+		WithVerbose(true),
+		WithBaggageKeys(func(ctx context.Context, key string) string {
+			members, _ := ctx.Value(baggageKey{}).(map[string]string)
+			return members[key]
+		}, "tenant", "origin"),
+		WithQueryHookOptions(QueryHookOptions{Logger: log, QueryLevel: logrus.DebugLevel}),
+	)
+	ctx := context.WithValue(context.Background(), baggageKey{}, map[string]string{"tenant": "acme", "other": "x"})
+	hook.AfterQuery(ctx, logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	hook.AfterQuery(context.Background(), logrusbuntest.NewQueryEvent("SELECT 1", nil, 0))
+	entries := recorder.Entries()
+	if len(entries) != 2 || entries[0].Data["baggage.tenant"] != "acme" || len(entries[0].Data) != 1 {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	if len(entries[1].Data) != 0 {
+		t.Errorf("expected no baggage fields, got %v", entries[1].Data)
+	}
+}
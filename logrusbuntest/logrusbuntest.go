@@ -0,0 +1,95 @@
+// Package logrusbuntest provides helpers to test logrusbun hooks: an in
+// memory logger recording levels and messages, and minimal bun query events.
+package logrusbuntest
+
+import (
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/uptrace/bun"
+)
+
+// Entry is a recorded log entry
+type Entry struct {
+	Level   logrus.Level
+	Message string
+	Data    logrus.Fields
+}
+
+// Recorder records the entries of a logger, it is safe for concurrent use
+type Recorder struct {
+	mu      sync.Mutex
+	entries []Entry
+}
+
+// NewLogger returns a logger accepting every level, discarding its output and
+// recording its entries
+func NewLogger() (*logrus.Logger, *Recorder) {
+	r := new(Recorder)
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.Level = logrus.TraceLevel
+	logger.ExitFunc = func(int) {}
+	logger.AddHook(r)
+	return logger, r
+}
+
+// Levels implements logrus.Hook
+func (r *Recorder) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook
+func (r *Recorder) Fire(e *logrus.Entry) error {
+	data := make(logrus.Fields, len(e.Data))
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	r.mu.Lock()
+	r.entries = append(r.entries, Entry{Level: e.Level, Message: e.Message, Data: data})
+	r.mu.Unlock()
+	return nil
+}
+
+// Entries returns a copy of the recorded entries
+func (r *Recorder) Entries() []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Entry(nil), r.entries...)
+}
+
+// Last returns the last recorded entry and whether there was one
+func (r *Recorder) Last() (Entry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) == 0 {
+		return Entry{}, false
+	}
+	return r.entries[len(r.entries)-1], true
+}
+
+// Len returns the number of recorded entries
+func (r *Recorder) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.entries)
+}
+
+// Reset drops the recorded entries
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	r.entries = nil
+	r.mu.Unlock()
+}
+
+// NewQueryEvent returns a minimal raw query event that took dur and failed
+// with err, if not nil
+func NewQueryEvent(query string, err error, dur time.Duration) *bun.QueryEvent {
+	return &bun.QueryEvent{
+		Query:     query,
+		StartTime: time.Now().Add(-dur),
+		Err:       err,
+	}
+}
@@ -0,0 +1,25 @@
+package logrusbuntest
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRecorder(t *testing.T) {
+	log, recorder := NewLogger()
+	log.WithField("a", 1).Trace("trace")
+	log.Error("error")
+
+	entries := recorder.Entries()
+	if len(entries) != 2 || entries[0].Level != logrus.TraceLevel || entries[0].Data["a"] != 1 {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	if last, ok := recorder.Last(); !ok || last.Message != "error" {
+		t.Fatalf("unexpected last entry: %v", last)
+	}
+	recorder.Reset()
+	if recorder.Len() != 0 {
+		t.Fatal("expected no entries after Reset")
+	}
+}
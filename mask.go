@@ -0,0 +1,46 @@
+package logrusbun
+
+import "regexp"
+
+// defaultMaskPatterns are the patterns masked by WithDefaultMasking. When a
+// pattern has a capture group, only the first group is masked
+var defaultMaskPatterns = []*regexp.Regexp{
+	// values compared or assigned to password, secret, token... columns
+	regexp.MustCompile("(?i)(?:password|passwd|secret|token|api_?key)\\w*[\"`]?\\s*(?:=|:=|:)\\s*('(?:[^']|'')*')"),
+	// bearer tokens
+	regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]+=*)`),
+	// JWTs
+	regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`),
+	// long hex strings, eg: API keys, hashes
+	regexp.MustCompile(`\b[0-9a-fA-F]{32,}\b`),
+	// long base64 strings
+	regexp.MustCompile(`[A-Za-z0-9+/]{40,}={0,2}`),
+}
+
+// MaskPatternEmail matches email addresses, it isn't part of the default
+// patterns and can be opted in with WithDefaultMasking(logrusbun.MaskPatternEmail)
+var MaskPatternEmail = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// maskPatterns replaces the matches of patterns in query with mask, or the
+// first capture group of patterns having one
+func maskPatterns(query, mask string, patterns []*regexp.Regexp) string {
+	for _, re := range patterns {
+		matches := re.FindAllStringSubmatchIndex(query, -1)
+		if matches == nil {
+			continue
+		}
+		masked := make([]byte, 0, len(query))
+		last := 0
+		for _, m := range matches {
+			start, end := m[0], m[1]
+			if len(m) >= 4 && m[2] >= 0 {
+				start, end = m[2], m[3]
+			}
+			masked = append(masked, query[last:start]...)
+			masked = append(masked, mask...)
+			last = end
+		}
+		query = string(append(masked, query[last:]...))
+	}
+	return query
+}
@@ -0,0 +1,141 @@
+package logrusbun
+
+import "strings"
+
+// keywords uppercased by prettyPrint
+var prettyKeywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "GROUP": true, "ORDER": true,
+	"BY": true, "HAVING": true, "LIMIT": true, "OFFSET": true, "RETURNING": true,
+	"INSERT": true, "INTO": true, "VALUES": true, "UPDATE": true, "SET": true,
+	"DELETE": true, "JOIN": true, "LEFT": true, "RIGHT": true, "INNER": true,
+	"FULL": true, "CROSS": true, "OUTER": true, "NATURAL": true, "ON": true,
+	"USING": true, "UNION": true, "INTERSECT": true, "EXCEPT": true, "ALL": true,
+	"AND": true, "OR": true, "NOT": true, "IN": true, "IS": true, "NULL": true,
+	"AS": true, "DISTINCT": true, "ASC": true, "DESC": true, "LIKE": true,
+	"ILIKE": true, "BETWEEN": true, "EXISTS": true, "CASE": true, "WHEN": true,
+	"THEN": true, "ELSE": true, "END": true, "WITH": true, "CONFLICT": true,
+	"DO": true, "NOTHING": true, "FOR": true, "TRUE": true, "FALSE": true,
+}
+
+// keywords starting a new line
+var prettyClauses = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "GROUP": true, "ORDER": true,
+	"HAVING": true, "LIMIT": true, "OFFSET": true, "RETURNING": true,
+	"INSERT": true, "VALUES": true, "UPDATE": true, "SET": true, "DELETE": true,
+	"JOIN": true, "LEFT": true, "RIGHT": true, "INNER": true, "FULL": true,
+	"CROSS": true, "NATURAL": true, "UNION": true, "INTERSECT": true,
+	"EXCEPT": true, "WITH": true,
+}
+
+// keywords after which a clause keyword stays on the same line, eg: LEFT JOIN,
+// DO UPDATE, FOR UPDATE, ON DELETE
+var prettyNoBreakAfter = map[string]bool{
+	"LEFT": true, "RIGHT": true, "INNER": true, "FULL": true, "CROSS": true,
+	"OUTER": true, "NATURAL": true, "DO": true, "FOR": true, "ON": true,
+	"UNION": true, "INTERSECT": true, "EXCEPT": true, "(": true,
+}
+
+// prettyPrint formats query over multiple indented lines with uppercased
+// keywords. It is a lightweight formatter meant for reading queries during
+// development, not a SQL parser
+func prettyPrint(query string) string {
+	tokens := sqlTokens(query)
+	var b strings.Builder
+	b.Grow(len(query) + len(query)/4)
+
+	// one entry per open parenthesis, true for subqueries
+	var parens []bool
+	level := 0
+	prev := ""
+	between := false
+	newline := func(indent int) {
+		b.WriteByte('\n')
+		b.WriteString(strings.Repeat("  ", indent))
+	}
+	inPlainParens := func() bool {
+		return len(parens) > 0 && !parens[len(parens)-1]
+	}
+
+	for i, tok := range tokens {
+		upper := strings.ToUpper(tok)
+		isKeyword := prettyKeywords[upper]
+		if isKeyword {
+			tok = upper
+		}
+
+		switch {
+		case i == 0:
+		case tok == ")":
+			if len(parens) > 0 && parens[len(parens)-1] {
+				level--
+				newline(level)
+			}
+		case tok == "," || tok == ";" || prev == "(":
+		case isKeyword && prettyClauses[upper] && !prettyNoBreakAfter[prev] && !inPlainParens():
+			newline(level)
+		case isKeyword && (upper == "AND" || upper == "OR") && !inPlainParens():
+			if upper == "AND" && between {
+				between = false
+				b.WriteByte(' ')
+			} else {
+				newline(level + 1)
+			}
+		default:
+			b.WriteByte(' ')
+		}
+		b.WriteString(tok)
+
+		switch {
+		case tok == "(":
+			subquery := i+1 < len(tokens) && strings.EqualFold(tokens[i+1], "SELECT")
+			parens = append(parens, subquery)
+			if subquery {
+				level++
+				newline(level)
+				// the SELECT following the parenthesis is already on its line
+				prev = "("
+				continue
+			}
+		case tok == ")":
+			if len(parens) > 0 {
+				parens = parens[:len(parens)-1]
+			}
+		case upper == "BETWEEN":
+			between = true
+		}
+		prev = upper
+	}
+	return b.String()
+}
+
+// sqlTokens splits query into words and punctuation, quoted strings and
+// identifiers are kept intact and whitespace is dropped
+func sqlTokens(query string) []string {
+	var tokens []string
+	for i := 0; i < len(query); {
+		switch c := query[i]; c {
+		case ' ', '\t', '\n', '\r':
+			i++
+		case '(', ')', ',', ';':
+			tokens = append(tokens, query[i:i+1])
+			i++
+		default:
+			end := i
+			for end < len(query) && !strings.ContainsRune(" \t\n\r(),;", rune(query[end])) {
+				if q := query[end]; q == '\'' || q == '"' || q == '`' {
+					end++
+					for end < len(query) && query[end] != q {
+						end++
+					}
+				}
+				end++
+			}
+			if end > len(query) {
+				end = len(query)
+			}
+			tokens = append(tokens, query[i:end])
+			i = end
+		}
+	}
+	return tokens
+}
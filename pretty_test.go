@@ -0,0 +1,43 @@
+package logrusbun
+
+import "testing"
+
+func TestPrettyPrint(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{
+			`select "u"."id", "u"."name" from "users" as "u" left join "orders" as "o" on "o"."user_id" = "u"."id" where "u"."id" in (1, 2) and "o"."total" between 1 and 10 order by "u"."id" limit 1`,
+			`SELECT "u"."id", "u"."name"
+FROM "users" AS "u"
+LEFT JOIN "orders" AS "o" ON "o"."user_id" = "u"."id"
+WHERE "u"."id" IN (1, 2)
+  AND "o"."total" BETWEEN 1 AND 10
+ORDER BY "u"."id"
+LIMIT 1`,
+		},
+		{
+			`SELECT * FROM t WHERE id IN (SELECT id FROM u WHERE name = 'select from'  )`,
+			`SELECT *
+FROM t
+WHERE id IN (
+  SELECT id
+  FROM u
+  WHERE name = 'select from'
+)`,
+		},
+		{
+			`INSERT INTO "t" ("a") VALUES (1) ON CONFLICT DO UPDATE SET "a" = 2 RETURNING "id"`,
+			`INSERT INTO "t" ("a")
+VALUES (1) ON CONFLICT DO UPDATE
+SET "a" = 2
+RETURNING "id"`,
+		},
+	}
+	for _, test := range tests {
+		if got := prettyPrint(test.query); got != test.want {
+			t.Errorf("prettyPrint(%q) =\n%s\nwant\n%s", test.query, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,736 @@
+package logrusbun
+
+import (
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/schema"
+)
+
+const (
+	// maxValuesScan bounds how many bytes of an INSERT are inspected when
+	// counting VALUES tuples
+	maxValuesScan = 64 << 10
+	// maxTablesScan bounds how many bytes of a query are inspected when
+	// looking for referenced tables
+	maxTablesScan = 8 << 10
+	// maxTables bounds the number of referenced tables reported
+	maxTables = 32
+)
+
+// identQuotes strips the quotes of identifiers
+var identQuotes = strings.NewReplacer(`"`, "", "`", "")
+
+type modelQuery interface {
+	GetModel() bun.Model
+}
+
+// eventModelValue returns the destination of the event's bun model, if any
+func eventModelValue(event *bun.QueryEvent) (reflect.Value, bool) {
+	q, ok := event.QueryAppender.(modelQuery)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	model := q.GetModel()
+	if model == nil {
+		return reflect.Value{}, false
+	}
+	v := reflect.ValueOf(model.Value())
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, false
+		}
+		v = v.Elem()
+	}
+	return v, v.IsValid()
+}
+
+// eventBatchSize returns the number of rows an INSERT writes, taken from the
+// model slice length or, for raw queries, by counting VALUES tuples
+func eventBatchSize(event *bun.QueryEvent, operation string) int {
+	if operation != "INSERT" {
+		return 0
+	}
+	if v, ok := eventModelValue(event); ok {
+		if v.Kind() == reflect.Slice {
+			return v.Len()
+		}
+		return 1
+	}
+	return countValuesTuples(event.Query)
+}
+
+// countValuesTuples counts the top level parenthesized groups following the
+// VALUES keyword, quoted strings are skipped. Only the first maxValuesScan
+// bytes of the query are inspected
+func countValuesTuples(query string) int {
+	if len(query) > maxValuesScan {
+		query = query[:maxValuesScan]
+	}
+	idx := indexKeyword(query, "VALUES")
+	if idx < 0 {
+		return 0
+	}
+	query = query[idx+len("VALUES"):]
+
+	var n, depth int
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			if depth == 0 {
+				n++
+			}
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && c != ',' && c != ' ' && c != '\n' && c != '\t':
+			// end of the VALUES list, eg: RETURNING
+			return n
+		}
+	}
+	return n
+}
+
+// indexKeyword returns the index of the first case-insensitive occurrence of
+// keyword, which must be uppercase ASCII, surrounded by non identifier
+// characters and outside of quoted strings and identifiers. query is not
+// copied, callers may search large queries in loops
+func indexKeyword(query, keyword string) int {
+	var quote byte
+	for i := 0; i+len(keyword) <= len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			// '' escaping a quote closes and reopens the string
+			if c == quote {
+				quote = 0
+			}
+			continue
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+			continue
+		}
+		// cheap first byte check before comparing the window
+		if c&^0x20 != keyword[0] || !strings.EqualFold(query[i:i+len(keyword)], keyword) {
+			continue
+		}
+		end := i + len(keyword)
+		if (i == 0 || !isIdentChar(query[i-1])) && (end == len(query) || !isIdentChar(query[end])) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// collapseInLists replaces IN (...) lists holding more than max elements with
+// a placeholder carrying the element count, subqueries are left untouched.
+// query is only copied when a list is collapsed
+func collapseInLists(query string, max int) string {
+	var b strings.Builder
+	// written is the end of the part of query already copied to b, pos where
+	// the search for the next list resumes
+	var written, pos int
+	for {
+		idx := indexKeyword(query[pos:], "IN")
+		if idx < 0 {
+			break
+		}
+		idx += pos
+		open := idx + len("IN")
+		for open < len(query) && query[open] == ' ' {
+			open++
+		}
+		if open >= len(query) || query[open] != '(' {
+			pos = idx + len("IN")
+			continue
+		}
+		end, count := scanList(query[open:])
+		if end < 0 || count <= max || indexKeyword(query[open:open+end], "SELECT") >= 0 {
+			pos = open + 1
+			continue
+		}
+		b.WriteString(query[written:idx])
+		b.WriteString("IN (... ")
+		b.WriteString(strconv.Itoa(count))
+		b.WriteString(" values ...)")
+		written = open + end + 1
+		pos = written
+	}
+	if written == 0 {
+		return query
+	}
+	b.WriteString(query[written:])
+	return b.String()
+}
+
+// scanList returns the index of the parenthesis closing the list opened at
+// s[0] and the number of top level elements, end is -1 if unbalanced
+func scanList(s string) (end int, count int) {
+	var depth int
+	var quote byte
+	count = 1
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i, count
+			}
+		case c == ',' && depth == 1:
+			count++
+		}
+	}
+	return -1, 0
+}
+
+type tableModel interface {
+	Table() *schema.Table
+}
+
+// eventTable returns the schema and table name of the event's bun model,
+// schema is empty when the table name isn't qualified
+func eventTable(event *bun.QueryEvent) (string, string) {
+	q, ok := event.QueryAppender.(modelQuery)
+	if !ok {
+		return "", ""
+	}
+	model, ok := q.GetModel().(tableModel)
+	if !ok || model.Table() == nil {
+		return "", ""
+	}
+	return splitTableName(model.Table().Name)
+}
+
+// relationModel is implemented by bun's table models, the relation is only
+// set on models bun creates to load has-many and many-to-many relations with
+// queries of their own
+type relationModel interface {
+	Relation() *schema.Relation
+	Root() reflect.Value
+	Index() []int
+}
+
+// eventRelation returns the path of the relation loaded by the event's query
+// and its depth, eg: "Posts.Comments" and 2 for
+// db.NewSelect().Model(&users).Relation("Posts.Comments"). It relies on the
+// models bun uses internally to load relations, other queries (and relation
+// queries, should these models change) yield "", 0
+func eventRelation(event *bun.QueryEvent) (string, int) {
+	q, ok := event.QueryAppender.(modelQuery)
+	if !ok {
+		return "", 0
+	}
+	model, ok := q.GetModel().(relationModel)
+	if !ok || model.Relation() == nil || model.Relation().Field == nil {
+		return "", 0
+	}
+	fallback := model.Relation().Field.GoName
+	root := model.Root()
+	if !root.IsValid() {
+		return fallback, 1
+	}
+	// walk the relation fields along the model's index from the root,
+	// the index goes through embedded structs too
+	var path []string
+	typ := root.Type()
+	for _, i := range model.Index() {
+		for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array {
+			typ = typ.Elem()
+		}
+		if typ.Kind() != reflect.Struct || i >= typ.NumField() {
+			return fallback, 1
+		}
+		field := typ.Field(i)
+		if isRelationTag(field.Tag.Get("bun")) {
+			path = append(path, field.Name)
+		}
+		typ = field.Type
+	}
+	if len(path) == 0 {
+		return fallback, 1
+	}
+	return strings.Join(path, "."), len(path)
+}
+
+func isRelationTag(tag string) bool {
+	for _, opt := range strings.Split(tag, ",") {
+		if strings.HasPrefix(opt, "rel:") || strings.HasPrefix(opt, "m2m:") {
+			return true
+		}
+	}
+	return false
+}
+
+// splitTableName splits a possibly schema qualified table name
+func splitTableName(name string) (string, string) {
+	name = strings.ReplaceAll(name, `"`, "")
+	if idx := strings.LastIndexByte(name, '.'); idx >= 0 {
+		return name[:idx], name[idx+1:]
+	}
+	return "", name
+}
+
+// eventRowsAffected returns the number of rows affected by the query when
+// its result is available
+func eventRowsAffected(event *bun.QueryEvent) (int64, bool) {
+	if event.Result == nil {
+		return 0, false
+	}
+	n, err := event.Result.RowsAffected()
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// redactArgs renders a raw query with every bound argument replaced by mask.
+// Queries built with bun's query builder are formatted before reaching the
+// hook, without argument boundaries, and are returned untouched
+func redactArgs(event *bun.QueryEvent, mask string) string {
+	if len(event.QueryArgs) == 0 || event.DB == nil || event.DB.Dialect() == nil {
+		return event.Query
+	}
+	masks := make([]interface{}, len(event.QueryArgs))
+	for i := range masks {
+		masks[i] = bun.Safe(mask)
+	}
+	return event.DB.Formatter().FormatQuery(event.Query, masks...)
+}
+
+// formatArgs renders up to max args as value:type, eg: [1:int, "foo":string],
+// the values are replaced by mask when set. Arguments past max are counted,
+// eg: [1:int, ... 2 more]
+func formatArgs(args []interface{}, max int, mask string) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, arg := range args {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		if i == max {
+			fmt.Fprintf(&b, "... %d more", len(args)-max)
+			break
+		}
+		switch v := arg.(type) {
+		case nil:
+			b.WriteString("nil")
+			continue
+		case string:
+			if mask == "" {
+				b.WriteString(strconv.Quote(v))
+			}
+		case []byte:
+			if mask == "" {
+				b.WriteString(strconv.Quote(string(v)))
+			}
+		default:
+			if mask == "" {
+				fmt.Fprint(&b, v)
+			}
+		}
+		if mask != "" {
+			b.WriteString(mask)
+		}
+		fmt.Fprintf(&b, ":%T", arg)
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// queryTokens tokenizes up to maxTablesScan bytes of a query, once, for the
+// parsers sharing the tokens: tables, columns and missingWhere
+type queryTokens struct {
+	query  string
+	tokens []string
+	done   bool
+}
+
+func (q *queryTokens) get() []string {
+	if !q.done {
+		query := q.query
+		if len(query) > maxTablesScan {
+			query = query[:maxTablesScan]
+		}
+		q.tokens, q.done = sqlTokens(query), true
+	}
+	return q.tokens
+}
+
+// queryTables returns the tables following FROM, JOIN, INTO and UPDATE in
+// query, in order of appearance and without duplicates. Subqueries are
+// skipped in place, their own FROM/JOIN clauses are still inspected, while
+// the arguments of function calls are not, eg: EXTRACT(YEAR FROM created_at)
+func queryTables(query string) []string {
+	return (&queryTokens{query: query}).tables()
+}
+
+func (q *queryTokens) tables() []string {
+	tokens := q.get()
+
+	var tables []string
+	add := func(tok string) {
+		if tok == "" || tok == "(" || prettyKeywords[strings.ToUpper(tok)] || len(tables) >= maxTables {
+			return
+		}
+		name := identQuotes.Replace(tok)
+		for _, table := range tables {
+			if table == name {
+				return
+			}
+		}
+		tables = append(tables, name)
+	}
+
+	// one entry per open parenthesis, true for function calls
+	var calls []bool
+	inCalls := 0
+	for i := 0; i < len(tokens)-1; i++ {
+		switch tokens[i] {
+		case "(":
+			call := i > 0 && !prettyKeywords[strings.ToUpper(tokens[i-1])] && tokens[i-1] != "(" && tokens[i-1] != "," &&
+				!strings.EqualFold(tokens[i+1], "SELECT")
+			calls = append(calls, call)
+			if call {
+				inCalls++
+			}
+			continue
+		case ")":
+			if n := len(calls); n > 0 {
+				if calls[n-1] {
+					inCalls--
+				}
+				calls = calls[:n-1]
+			}
+			continue
+		}
+		if inCalls > 0 {
+			continue
+		}
+		switch strings.ToUpper(tokens[i]) {
+		case "FROM":
+			// FROM a, b
+			for j := i + 1; j < len(tokens); j++ {
+				add(tokens[j])
+				// skip an optional alias
+				for j+1 < len(tokens) && tokens[j+1] != "," && !prettyKeywords[strings.ToUpper(tokens[j+1])] && tokens[j+1] != ")" && tokens[j+1] != "(" {
+					j++
+				}
+				if j+1 >= len(tokens) || tokens[j+1] != "," {
+					break
+				}
+				j++
+			}
+		case "JOIN", "INTO":
+			add(tokens[i+1])
+		case "UPDATE":
+			// ON CONFLICT DO UPDATE, SELECT ... FOR UPDATE
+			if i > 0 {
+				if prev := strings.ToUpper(tokens[i-1]); prev == "DO" || prev == "FOR" {
+					continue
+				}
+			}
+			add(tokens[i+1])
+		}
+	}
+	return tables
+}
+
+// maxColumns bounds the number of columns reported by queryColumns
+const maxColumns = 64
+
+// queryColumns returns the columns selected by a SELECT, set by an UPDATE or
+// listed by an INSERT, without their table qualifier. bun doesn't expose the
+// columns of a query, they are parsed out of it conservatively: expressions,
+// subqueries and * are skipped, as are queries starting otherwise, eg: WITH
+func queryColumns(query string) []string {
+	return (&queryTokens{query: query}).columns()
+}
+
+func (q *queryTokens) columns() []string {
+	tokens := q.get()
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	var columns []string
+	add := func(tok string) {
+		if name, ok := columnName(tok); ok && len(columns) < maxColumns {
+			columns = append(columns, name)
+		}
+	}
+
+	switch strings.ToUpper(tokens[0]) {
+	case "SELECT":
+		// SELECT [DISTINCT] a, t.b AS c, count(*) FROM
+		for _, item := range splitTopLevel(tokens[1:], "FROM") {
+			if len(item) > 0 && strings.EqualFold(item[0], "DISTINCT") {
+				item = item[1:]
+			}
+			if len(item) == 1 || len(item) == 3 && strings.EqualFold(item[1], "AS") {
+				add(item[0])
+			}
+		}
+	case "UPDATE":
+		// UPDATE t SET a = 1, b = DEFAULT WHERE
+		for i, tok := range tokens {
+			if strings.EqualFold(tok, "SET") {
+				for _, item := range splitTopLevel(tokens[i+1:], "FROM", "WHERE", "RETURNING") {
+					if len(item) >= 2 && item[1] == "=" {
+						add(item[0])
+					}
+				}
+				break
+			}
+		}
+	case "INSERT":
+		// INSERT INTO t (a, b) VALUES
+		for i := 0; i+3 < len(tokens); i++ {
+			if strings.EqualFold(tokens[i], "INTO") {
+				if tokens[i+2] != "(" {
+					break
+				}
+				for _, tok := range tokens[i+3:] {
+					if tok == ")" {
+						break
+					}
+					if tok != "," {
+						add(tok)
+					}
+				}
+				break
+			}
+		}
+	}
+	return columns
+}
+
+// splitTopLevel splits tokens on top level commas up to the first top level
+// occurrence of one of the keywords
+func splitTopLevel(tokens []string, keywords ...string) [][]string {
+	var items [][]string
+	var item []string
+	depth := 0
+tokens:
+	for _, tok := range tokens {
+		switch tok {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		case ",", ";":
+			if depth == 0 {
+				items = append(items, item)
+				item = nil
+				if tok == ";" {
+					break tokens
+				}
+				continue
+			}
+		default:
+			if depth == 0 {
+				for _, keyword := range keywords {
+					if strings.EqualFold(tok, keyword) {
+						break tokens
+					}
+				}
+			}
+		}
+		item = append(item, tok)
+	}
+	return append(items, item)
+}
+
+// columnName returns the unquoted column of a possibly qualified identifier,
+// eg: id for "u"."id", reporting false for anything else
+func columnName(tok string) (string, bool) {
+	var name string
+	for _, part := range strings.Split(tok, ".") {
+		if n := len(part); n >= 2 && (part[0] == '"' && part[n-1] == '"' || part[0] == '`' && part[n-1] == '`') {
+			part = part[1 : n-1]
+		} else {
+			if part == "" {
+				return "", false
+			}
+			for i := 0; i < len(part); i++ {
+				if !isIdentChar(part[i]) {
+					return "", false
+				}
+			}
+			if c := part[0]; c >= '0' && c <= '9' {
+				return "", false
+			}
+		}
+		name = part
+	}
+	// SELECT NULL, SET a = DEFAULT...
+	if !strings.ContainsAny(tok, ".\"`") {
+		switch upper := strings.ToUpper(tok); upper {
+		case "NULL", "TRUE", "FALSE", "DEFAULT":
+			return "", false
+		default:
+			if prettyKeywords[upper] {
+				return "", false
+			}
+		}
+	}
+	return name, name != ""
+}
+
+// eventRowsReturned returns the number of rows scanned by a SELECT into a
+// slice model, bun doesn't report it otherwise
+func eventRowsReturned(event *bun.QueryEvent) (int, bool) {
+	if _, ok := event.QueryAppender.(*bun.SelectQuery); !ok {
+		return 0, false
+	}
+	v, ok := eventModelValue(event)
+	if !ok || v.Kind() != reflect.Slice {
+		return 0, false
+	}
+	return v.Len(), true
+}
+
+// resultPreview returns the string representation of up to n rows scanned
+// by a SELECT into its model
+func resultPreview(event *bun.QueryEvent, n int) []string {
+	if _, ok := event.QueryAppender.(*bun.SelectQuery); !ok || n <= 0 {
+		return nil
+	}
+	v, ok := eventModelValue(event)
+	if !ok {
+		return nil
+	}
+	if v.Kind() != reflect.Slice {
+		return []string{fmt.Sprintf("%+v", v.Interface())}
+	}
+	if v.Len() < n {
+		n = v.Len()
+	}
+	preview := make([]string, n)
+	for i := range preview {
+		preview[i] = fmt.Sprintf("%+v", v.Index(i).Interface())
+	}
+	return preview
+}
+
+// missingWhere reports whether query is a single UPDATE or DELETE statement
+// without a WHERE clause of its own, WHERE clauses of subqueries don't count.
+// It errs on the side of silence: queries too long to inspect, starting
+// with anything else (eg: WITH) or holding several statements are ignored
+func missingWhere(query string) bool {
+	return (&queryTokens{query: query}).missingWhere()
+}
+
+func (q *queryTokens) missingWhere() bool {
+	if len(q.query) > maxTablesScan {
+		return false
+	}
+	tokens := q.get()
+	if len(tokens) == 0 {
+		return false
+	}
+	if first := strings.ToUpper(tokens[0]); first != "UPDATE" && first != "DELETE" {
+		return false
+	}
+	depth := 0
+	for i, tok := range tokens {
+		switch tok {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		case ";":
+			if i != len(tokens)-1 {
+				return false
+			}
+		default:
+			if depth == 0 && strings.EqualFold(tok, "WHERE") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// queryFingerprint identifies the shape of query regardless of its values:
+// string and numeric literals are replaced with ?, lists of them collapsed to
+// a single ?, whitespace collapsed and letters lowercased. The normalized
+// query is hashed with FNV-64a, the fingerprint is its 16 hex digits
+func queryFingerprint(query string) string {
+	hash := fnv.New64a()
+	hash.Write(normalizeQuery(query))
+	return fmt.Sprintf("%016x", hash.Sum64())
+}
+
+func normalizeQuery(query string) []byte {
+	out := make([]byte, 0, len(query))
+	space := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+			continue
+		case c == '\'':
+			// '' escapes a quote within the literal
+			for i++; i < len(query); i++ {
+				if query[i] != '\'' {
+					continue
+				}
+				if i+1 < len(query) && query[i+1] == '\'' {
+					i++
+					continue
+				}
+				break
+			}
+			c = '?'
+		case c >= '0' && c <= '9' && (i == 0 || !isIdentChar(query[i-1])):
+			for i+1 < len(query) && (isIdentChar(query[i+1]) || query[i+1] == '.') {
+				i++
+			}
+			c = '?'
+		case c >= 'A' && c <= 'Z':
+			c += 'a' - 'A'
+		}
+		if space && len(out) > 0 {
+			out = append(out, ' ')
+		}
+		space = false
+		if c == '?' {
+			// (1, 2, 3) and (1) share a fingerprint
+			if n := len(out); n >= 3 && string(out[n-3:]) == "?, " {
+				out = out[:n-2]
+				continue
+			} else if n >= 2 && string(out[n-2:]) == "?," {
+				out = out[:n-1]
+				continue
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
@@ -0,0 +1,292 @@
+package logrusbun
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/schema"
+)
+
+func TestCountValuesTuples(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{`SELECT 1`, 0},
+		{`INSERT INTO "t" ("a") VALUES (1)`, 1},
+		{`INSERT INTO "t" ("a", "b") VALUES (1, 'x'), (2, ')'), (3, '(')`, 3},
+		{`INSERT INTO "t" ("a") VALUES (1), (2) RETURNING "id"`, 2},
+		{`insert into t (a) values ((1)), ((2))`, 2},
+		// VALUES past the scanned prefix
+		{`INSERT INTO "t" ("a") SELECT '` + strings.Repeat("x", maxValuesScan) + `' VALUES (1)`, 0},
+	}
+	for _, test := range tests {
+		if got := countValuesTuples(test.query); got != test.want {
+			t.Errorf("countValuesTuples(%q) = %d, want %d", test.query, got, test.want)
+		}
+	}
+}
+
+func TestCollapseInLists(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`SELECT * FROM t WHERE id IN (1, 2)`, `SELECT * FROM t WHERE id IN (1, 2)`},
+		{`SELECT * FROM t WHERE id IN (1, 2, 3, 4)`, `SELECT * FROM t WHERE id IN (... 4 values ...)`},
+		{`SELECT * FROM t WHERE id IN (1,2,3) AND name IN ('a', 'b,c')`, `SELECT * FROM t WHERE id IN (... 3 values ...) AND name IN ('a', 'b,c')`},
+		{`SELECT * FROM t WHERE id IN (SELECT id FROM u WHERE x IN (1, 2, 3))`, `SELECT * FROM t WHERE id IN (SELECT id FROM u WHERE x IN (... 3 values ...))`},
+		{`SELECT * FROM t WHERE (a, b) IN ((1, 2), (3, 4), (5, 6))`, `SELECT * FROM t WHERE (a, b) IN (... 3 values ...)`},
+		{`SELECT * FROM join_index WHERE x IN (1`, `SELECT * FROM join_index WHERE x IN (1`},
+		{`SELECT 'x IN (1,2,3)' FROM t`, `SELECT 'x IN (1,2,3)' FROM t`},
+		{`SELECT 'it''s IN (1,2,3)' FROM t WHERE id IN (1, 2, 3)`, `SELECT 'it''s IN (1,2,3)' FROM t WHERE id IN (... 3 values ...)`},
+		{`SELECT * FROM t WHERE op IN ('SELECT', 'INSERT', 'UPDATE')`, `SELECT * FROM t WHERE op IN (... 3 values ...)`},
+	}
+	for _, test := range tests {
+		if got := collapseInLists(test.query, 2); got != test.want {
+			t.Errorf("collapseInLists(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+
+	// searching for IN lists doesn't copy the query
+	query := strings.Repeat("SELECT * FROM t WHERE id IN (1, 2) AND ", 1000) + "true"
+	if allocs := testing.AllocsPerRun(10, func() { collapseInLists(query, 2) }); allocs != 0 {
+		t.Errorf("expected no allocations without lists to collapse, got %v", allocs)
+	}
+}
+
+func TestSplitTableName(t *testing.T) {
+	tests := []struct {
+		name, schema, table string
+	}{
+		{"users", "", "users"},
+		{"public.users", "public", "users"},
+		{`"audit"."events"`, "audit", "events"},
+	}
+	for _, test := range tests {
+		schema, table := splitTableName(test.name)
+		if schema != test.schema || table != test.table {
+			t.Errorf("splitTableName(%q) = %q, %q, want %q, %q", test.name, schema, table, test.schema, test.table)
+		}
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	db := newTestDB()
+	event := &bun.QueryEvent{
+		DB:        db,
+		Query:     "SELECT * FROM users WHERE email = ? AND id = ?",
+		QueryArgs: []interface{}{"jane@example.com", 42},
+	}
+	if got, want := redactArgs(event, "***"), "SELECT * FROM users WHERE email = *** AND id = ***"; got != want {
+		t.Errorf("redactArgs() = %q, want %q", got, want)
+	}
+
+	event = &bun.QueryEvent{Query: "SELECT 1"}
+	if got := redactArgs(event, "***"); got != "SELECT 1" {
+		t.Errorf("expected query without args to be untouched, got %q", got)
+	}
+}
+
+func TestQueryTables(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{`SELECT 1`, nil},
+		{`SELECT "u"."id" FROM "users" AS "u" LEFT JOIN "orders" AS "o" ON "o"."user_id" = "u"."id" JOIN public.items i ON true`, []string{"users", "orders", "public.items"}},
+		{`SELECT * FROM a, b x, c WHERE a.id IN (SELECT id FROM d)`, []string{"a", "b", "c", "d"}},
+		{`INSERT INTO "t" ("a") VALUES (1) ON CONFLICT DO UPDATE SET "a" = 2`, []string{"t"}},
+		{`UPDATE "t" SET "a" = 1 FROM "u" WHERE "t"."id" = "u"."id"`, []string{"t", "u"}},
+		{`SELECT * FROM (SELECT * FROM "t") AS sub`, []string{"t"}},
+		{`SELECT * FROM users JOIN users ON true`, []string{"users"}},
+		{`SELECT EXTRACT(YEAR FROM created_at), substring(name FROM 2) FROM t`, []string{"t"}},
+		{`SELECT * FROM t WHERE id = ANY(SELECT id FROM u)`, []string{"t", "u"}},
+	}
+	for _, test := range tests {
+		got := queryTables(test.query)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("queryTables(%q) = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestResultPreview(t *testing.T) {
+	type row struct {
+		ID int64
+	}
+	db := newTestDB()
+	rows := []row{{1}, {2}, {3}}
+	event := &bun.QueryEvent{QueryAppender: db.NewSelect().Model(&rows)}
+	if got, want := resultPreview(event, 2), []string{"{ID:1}", "{ID:2}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resultPreview() = %v, want %v", got, want)
+	}
+
+	single := row{4}
+	event = &bun.QueryEvent{QueryAppender: db.NewSelect().Model(&single)}
+	if got, want := resultPreview(event, 2), []string{"{ID:4}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resultPreview() = %v, want %v", got, want)
+	}
+
+	event = &bun.QueryEvent{QueryAppender: db.NewInsert().Model(&rows)}
+	if got := resultPreview(event, 2); got != nil {
+		t.Errorf("expected no preview for inserts, got %v", got)
+	}
+}
+
+// testRelationQuery and testRelationModel mimic the models bun creates to
+// load has-many relations, which can't be built without a database
+type testRelationQuery struct {
+	model bun.Model
+}
+
+func (q testRelationQuery) GetModel() bun.Model { return q.model }
+func (q testRelationQuery) AppendQuery(schema.Formatter, []byte) ([]byte, error) {
+	return nil, nil
+}
+
+type testRelationModel struct {
+	root  reflect.Value
+	index []int
+	rel   *schema.Relation
+}
+
+func (m testRelationModel) ScanRows(context.Context, *sql.Rows) (int, error) { return 0, nil }
+func (m testRelationModel) Value() interface{}                               { return nil }
+func (m testRelationModel) Relation() *schema.Relation                       { return m.rel }
+func (m testRelationModel) Root() reflect.Value                              { return m.root }
+func (m testRelationModel) Index() []int                                     { return m.index }
+
+func TestEventRelation(t *testing.T) {
+	type comment struct {
+		ID int64
+	}
+	type postComments struct {
+		Comments []comment `bun:"rel:has-many,join:id=post_id"`
+	}
+	type post struct {
+		ID int64
+		postComments
+	}
+	type user struct {
+		ID    int64
+		Posts []*post `bun:"rel:has-many,join:id=user_id"`
+	}
+
+	users := []user{}
+	rel := &schema.Relation{Field: &schema.Field{GoName: "Comments"}}
+	event := &bun.QueryEvent{QueryAppender: testRelationQuery{testRelationModel{reflect.ValueOf(&users).Elem(), []int{1, 1, 0}, rel}}}
+	if relation, depth := eventRelation(event); relation != "Posts.Comments" || depth != 2 {
+		t.Errorf("eventRelation() = %q, %d, want Posts.Comments, 2", relation, depth)
+	}
+
+	event = &bun.QueryEvent{QueryAppender: testRelationQuery{testRelationModel{reflect.Value{}, nil, rel}}}
+	if relation, depth := eventRelation(event); relation != "Comments" || depth != 1 {
+		t.Errorf("expected the relation name without a root, got %q, %d", relation, depth)
+	}
+
+	// bun's own models must keep exposing the relation
+	type row struct {
+		ID int64
+	}
+	rows := []row{}
+	q := newTestDB().NewSelect().Model(&rows)
+	if _, ok := q.GetModel().(relationModel); !ok {
+		t.Fatal("expected bun table models to implement relationModel")
+	}
+	if relation, depth := eventRelation(&bun.QueryEvent{QueryAppender: q}); relation != "" || depth != 0 {
+		t.Errorf("expected no relation for the root query, got %q, %d", relation, depth)
+	}
+}
+
+func TestMissingWhere(t *testing.T) {
+	for query, want := range map[string]bool{
+		`UPDATE "users" SET "name" = 'x'`:                                       true,
+		`DELETE FROM "users";`:                                                  true,
+		`delete from users`:                                                     true,
+		`UPDATE users SET n = (SELECT max(n) FROM t WHERE t.id = 1)`:            true,
+		`UPDATE "users" SET "name" = 'x' WHERE "id" = 1`:                        false,
+		`DELETE FROM "users" WHERE "id" IN (SELECT id FROM t)`:                  false,
+		`UPDATE users SET note = 'no WHERE here' WHERE id = 1`:                  false,
+		`UPDATE users SET note = 'WHERE'`:                                       true,
+		`SELECT * FROM users`:                                                   false,
+		`WITH t AS (SELECT 1) DELETE FROM users`:                                false,
+		`DELETE FROM users; DELETE FROM orders WHERE id = 1`:                    false,
+		`INSERT INTO users (name) VALUES ('x') ON CONFLICT DO UPDATE SET n = 1`: false,
+	} {
+		if got := missingWhere(query); got != want {
+			t.Errorf("%s: expected %v, got %v", query, want, got)
+		}
+	}
+}
+
+func TestQueryFingerprint(t *testing.T) {
+	same := [][2]string{
+		{`SELECT * FROM "users" WHERE "id" = 1`, "select *  from \"users\"\n\twhere \"id\" = 42"},
+		{`SELECT * FROM t WHERE name = 'a'`, `SELECT * FROM t WHERE name = 'it''s'`},
+		{`SELECT * FROM t WHERE id IN (1, 2, 3)`, `SELECT * FROM t WHERE id IN (4)`},
+		{`SELECT * FROM t WHERE x = 1.5`, `SELECT * FROM t WHERE x = 2`},
+	}
+	for _, test := range same {
+		if a, b := queryFingerprint(test[0]), queryFingerprint(test[1]); a != b {
+			t.Errorf("expected %q and %q to share a fingerprint, got %s and %s", test[0], test[1], a, b)
+		}
+	}
+	different := [][2]string{
+		{`SELECT * FROM t1 WHERE id = 1`, `SELECT * FROM t2 WHERE id = 1`},
+		{`SELECT * FROM t WHERE a = 1`, `SELECT * FROM t WHERE b = 1`},
+		{`SELECT * FROM t WHERE a = 1 AND b = 2`, `SELECT * FROM t WHERE a = 1`},
+	}
+	for _, test := range different {
+		if a, b := queryFingerprint(test[0]), queryFingerprint(test[1]); a == b {
+			t.Errorf("expected %q and %q to have different fingerprints, got %s", test[0], test[1], a)
+		}
+	}
+	if got := string(normalizeQuery(`SELECT "t1"."a" FROM t1 WHERE b IN ('x', 'y')  LIMIT 10`)); got != `select "t1"."a" from t1 where b in (?) limit ?` {
+		t.Errorf("unexpected normalized query: %q", got)
+	}
+}
+
+func TestFormatArgs(t *testing.T) {
+	args := []interface{}{1, "foo", []byte("b"), nil, 1.5}
+	tests := []struct {
+		max  int
+		mask string
+		want string
+	}{
+		{10, "", `[1:int, "foo":string, "b":[]uint8, nil, 1.5:float64]`},
+		{2, "", `[1:int, "foo":string, ... 3 more]`},
+		{2, "***", `[***:int, ***:string, ... 3 more]`},
+	}
+	for _, test := range tests {
+		if got := formatArgs(args, test.max, test.mask); got != test.want {
+			t.Errorf("formatArgs(%d, %q) = %s, want %s", test.max, test.mask, got, test.want)
+		}
+	}
+}
+
+func TestQueryColumns(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{`SELECT "u"."id", "u"."name" AS "n", count(*), 1, NULL FROM "users" AS "u"`, []string{"id", "name"}},
+		{`SELECT DISTINCT email FROM users WHERE id IN (SELECT user_id FROM orders)`, []string{"email"}},
+		{`SELECT "u".* FROM "users" AS "u"`, nil},
+		{`UPDATE "users" AS "u" SET "name" = 'x', "age" = "age" + 1 WHERE "u"."id" = 1`, []string{"name", "age"}},
+		{`UPDATE users SET a = _data.a FROM (VALUES (1, 2)) AS _data (id, a) WHERE users.id = _data.id`, []string{"a"}},
+		{`INSERT INTO "users" ("id", "name") VALUES (1, 'a') RETURNING "id"`, []string{"id", "name"}},
+		{`INSERT INTO users VALUES (1, 'a')`, nil},
+		{`WITH x AS (SELECT a FROM t) SELECT a FROM x`, nil},
+		{`DELETE FROM users WHERE id = 1`, nil},
+	}
+	for _, test := range tests {
+		if got := queryColumns(test.query); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("queryColumns(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
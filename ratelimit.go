@@ -0,0 +1,87 @@
+package logrusbun
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a minimal concurrency safe token bucket holding up to rate
+// tokens, refilled at rate tokens per second
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(perSecond int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(perSecond),
+		tokens: float64(perSecond),
+	}
+}
+
+// allow consumes a token if one is available at now
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// maxRateLimitFingerprints bounds the number of queries tracked by
+// queryRateLimit, the least recently logged ones are evicted first
+const maxRateLimitFingerprints = 1024
+
+// queryRateLimit gives every query fingerprint a token bucket of its own
+type queryRateLimit struct {
+	mu        sync.Mutex
+	perSecond int
+	buckets   map[string]*list.Element
+	recency   *list.List
+}
+
+type queryBucket struct {
+	fingerprint string
+	bucket      *tokenBucket
+}
+
+func newQueryRateLimit(perSecond int) *queryRateLimit {
+	return &queryRateLimit{
+		perSecond: perSecond,
+		buckets:   make(map[string]*list.Element),
+		recency:   list.New(),
+	}
+}
+
+// allow consumes a token of the fingerprint's bucket if one is available at
+// now. An evicted fingerprint starts over with a full bucket
+func (l *queryRateLimit) allow(fingerprint string, now time.Time) bool {
+	l.mu.Lock()
+	elem, ok := l.buckets[fingerprint]
+	if ok {
+		l.recency.MoveToFront(elem)
+	} else {
+		if l.recency.Len() >= maxRateLimitFingerprints {
+			oldest := l.recency.Back()
+			l.recency.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*queryBucket).fingerprint)
+		}
+		elem = l.recency.PushFront(&queryBucket{fingerprint: fingerprint, bucket: newTokenBucket(l.perSecond)})
+		l.buckets[fingerprint] = elem
+	}
+	bucket := elem.Value.(*queryBucket).bucket
+	l.mu.Unlock()
+	return bucket.allow(now)
+}
@@ -0,0 +1,44 @@
+package logrusbun
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2)
+	now := time.Now()
+	if !b.allow(now) || !b.allow(now) {
+		t.Fatal("expected the initial burst to be allowed")
+	}
+	if b.allow(now) {
+		t.Fatal("expected the bucket to be exhausted")
+	}
+	if !b.allow(now.Add(500 * time.Millisecond)) {
+		t.Fatal("expected a token to be refilled after half a second")
+	}
+	if b.allow(now.Add(500 * time.Millisecond)) {
+		t.Fatal("expected a single token to be refilled")
+	}
+}
+
+func TestQueryRateLimit(t *testing.T) {
+	l := newQueryRateLimit(1)
+	now := time.Now()
+	if !l.allow("a", now) || !l.allow("b", now) {
+		t.Fatal("expected every fingerprint to have its own budget")
+	}
+	if l.allow("a", now) {
+		t.Fatal("expected the fingerprint to be exhausted")
+	}
+	for i := 0; i < maxRateLimitFingerprints; i++ {
+		l.allow(strconv.Itoa(i), now)
+	}
+	if len(l.buckets) != maxRateLimitFingerprints || l.recency.Len() != maxRateLimitFingerprints {
+		t.Fatalf("expected %d tracked fingerprints, got %d", maxRateLimitFingerprints, len(l.buckets))
+	}
+	if !l.allow("a", now) {
+		t.Error("expected an evicted fingerprint to start over")
+	}
+}
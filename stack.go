@@ -0,0 +1,103 @@
+package logrusbun
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// stackSkipPrefixes are the functions skipped at the top of captured stacks
+// for them to start at the application code issuing the query
+var stackSkipPrefixes = []string{
+	"github.com/oiime/logrusbun.(*QueryHook).",
+	"github.com/oiime/logrusbun.callerStack",
+	"github.com/oiime/logrusbun.callerModule",
+	"github.com/uptrace/bun.",
+	"github.com/uptrace/bun/",
+	"database/sql.",
+	"runtime.",
+}
+
+// maxStackScan bounds the number of frames inspected, including the skipped
+// ones
+const maxStackScan = 64
+
+// callerStack returns up to depth frames of the calling goroutine, one
+// "function file:line" per line, starting at the first frame outside of the
+// hook, bun and database/sql
+func callerStack(depth int) string {
+	pcs := make([]uintptr, maxStackScan)
+	n := runtime.Callers(1, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var b strings.Builder
+	skipping := true
+	for written := 0; written < depth; {
+		frame, more := frames.Next()
+		if skipping && hasAnyPrefix(frame.Function, stackSkipPrefixes) {
+			if !more {
+				break
+			}
+			continue
+		}
+		skipping = false
+		if written > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(frame.Function)
+		b.WriteByte(' ')
+		b.WriteString(frame.File)
+		b.WriteByte(':')
+		b.WriteString(strconv.Itoa(frame.Line))
+		written++
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
+
+// callerModule returns the package path of the first frame of the calling
+// goroutine outside of the hook, bun and database/sql, with prefix trimmed.
+// Resolving a frame is the costly part, package paths are cached in cache per
+// program counter, an empty path for skipped frames
+func callerModule(prefix string, cache *sync.Map) string {
+	var pcs [maxStackScan]uintptr
+	n := runtime.Callers(1, pcs[:])
+	for _, pc := range pcs[:n] {
+		pkg, ok := cache.Load(pc)
+		if !ok {
+			frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+			pkg = ""
+			if !hasAnyPrefix(frame.Function, stackSkipPrefixes) {
+				pkg = funcPackage(frame.Function)
+			}
+			cache.Store(pc, pkg)
+		}
+		if pkg != "" {
+			return strings.TrimPrefix(pkg.(string), prefix)
+		}
+	}
+	return ""
+}
+
+// funcPackage returns the package path of a function name as reported by
+// runtime, eg: github.com/acme/app/repo/users for
+// github.com/acme/app/repo/users.(*Repo).Get
+func funcPackage(function string) string {
+	slash := strings.LastIndexByte(function, '/')
+	if dot := strings.IndexByte(function[slash+1:], '.'); dot >= 0 {
+		return function[:slash+1+dot]
+	}
+	return function
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
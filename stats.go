@@ -0,0 +1,100 @@
+package logrusbun
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/uptrace/bun"
+)
+
+// Summary aggregates the queries observed by an enabled hook, SlowestQuery
+// is redacted like the logged queries
+type Summary struct {
+	Queries         uint64
+	Errors          uint64
+	TotalDuration   time.Duration
+	SlowestDuration time.Duration
+	SlowestQuery    string
+	Dropped         uint64
+}
+
+type stats struct {
+	queries       uint64
+	errors        uint64
+	totalDuration int64
+	dropped       uint64
+
+	mu              sync.Mutex
+	slowestDuration time.Duration
+	slowestQuery    string
+}
+
+// record counts the event, the query of the slowest one is kept as returned
+// by redact, not to leak what the logged queries mask
+func (s *stats) record(event *bun.QueryEvent, dur time.Duration, redact func(*bun.QueryEvent) string) {
+	atomic.AddUint64(&s.queries, 1)
+	atomic.AddInt64(&s.totalDuration, int64(dur))
+	switch event.Err {
+	case nil, sql.ErrNoRows:
+	default:
+		atomic.AddUint64(&s.errors, 1)
+	}
+
+	s.mu.Lock()
+	slowest := dur > s.slowestDuration
+	s.mu.Unlock()
+	if !slowest {
+		return
+	}
+	// redacted outside of the lock, the query may be large
+	query := redact(event)
+	s.mu.Lock()
+	if dur > s.slowestDuration {
+		s.slowestDuration = dur
+		s.slowestQuery = query
+	}
+	s.mu.Unlock()
+}
+
+func (s *stats) drop() {
+	atomic.AddUint64(&s.dropped, 1)
+}
+
+// Summary returns the aggregates of all queries observed so far
+func (h *QueryHook) Summary() Summary {
+	h.stats.mu.Lock()
+	defer h.stats.mu.Unlock()
+	return Summary{
+		Queries:         atomic.LoadUint64(&h.stats.queries),
+		Errors:          atomic.LoadUint64(&h.stats.errors),
+		TotalDuration:   time.Duration(atomic.LoadInt64(&h.stats.totalDuration)),
+		SlowestDuration: h.stats.slowestDuration,
+		SlowestQuery:    h.stats.slowestQuery,
+		Dropped:         atomic.LoadUint64(&h.stats.dropped),
+	}
+}
+
+// LogSummary emits the Summary as a single log entry at the given level,
+// typically at the end of a batch job, after flushing pending repeats, see
+// Flush
+func (h *QueryHook) LogSummary(level logrus.Level) {
+	h.Flush()
+	s := h.Summary()
+	logger := h.opts.Logger
+	if h.structured {
+		logger = logger.WithFields(logrus.Fields{
+			"queries":          s.Queries,
+			"errors":           s.Errors,
+			"total_duration":   s.TotalDuration,
+			"slowest_duration": s.SlowestDuration,
+			"slowest_query":    s.SlowestQuery,
+			"dropped":          s.Dropped,
+		})
+	}
+	logAt(logger, level, fmt.Sprintf("%d queries, %d errors, %d dropped, %s total, slowest[%s]: %s",
+		s.Queries, s.Errors, s.Dropped, s.TotalDuration, s.SlowestDuration, s.SlowestQuery))
+}